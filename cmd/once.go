@@ -0,0 +1,108 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dansteen/consuldog/communicator"
+	"github.com/dansteen/consuldog/datadog"
+	"github.com/dansteen/consuldog/services"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// oneShotConsulTimeout is how long commands that run a single time keep trying to get our node name from consul
+const oneShotConsulTimeout = 15 * time.Second
+
+// onceCmd represents the once command
+var onceCmd = &cobra.Command{
+	Use:   "once",
+	Short: "Render datadog configs from the current state of consul and exit",
+	Long: `Read the services for our nodes from consul a single time, write out the datadog configs for them, and
+exit.  The exit code is non-zero if consul could not be read, or if any template or config file could not
+be generated.`,
+	Run: once,
+}
+
+func init() {
+	RootCmd.AddCommand(onceCmd)
+
+	RootCmd.PersistentFlags().Bool("reload", false, "when running once, reload datadog if any config files were changed")
+}
+
+func once(cmd *cobra.Command, args []string) {
+	// log errors to stderr
+	logger := log.New(os.Stderr, log.Prefix(), 0)
+	if viper.GetBool("reload") {
+		checkReloadSettings()
+	}
+	client := communicator.NewConsulClient(consulConfig())
+	allServices := services.NewServices()
+	success := true
+
+	nodes, err := oneShotNodeNames(client)
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+
+	// read the current services for each of our nodes
+	for _, node := range nodes {
+		nodeServices, err := client.NodeServices(node)
+		if err != nil {
+			logger.Println(err)
+			logger.Printf("Could not read services for node %s.\n", node)
+			success = false
+			continue
+		}
+		for _, service := range nodeServices.Services {
+			log.Printf("Found Service: %s -- %s -- %s:%d\n", nodeServices.Node, service.Service, service.Address, service.Port)
+			allServices.Add(service)
+		}
+	}
+
+	// if we could not read a node, writing configs now would remove all of its monitoring
+	if !success {
+		os.Exit(1)
+	}
+
+	changed, _, err := datadog.WriteConfig(allServices, &client)
+	if err != nil {
+		logger.Println(err)
+		success = false
+	}
+
+	// datadog only needs to be reloaded if we actually changed something
+	if viper.GetBool("reload") && len(changed) > 0 {
+		if !datadog.Reload(context.Background()) {
+			success = false
+		}
+	}
+
+	if !success {
+		os.Exit(1)
+	}
+}
+
+// oneShotNodeNames works out our nodes just like nodeNames, but gives up if consul can't tell us in time so that
+// commands that run a single time fail rather than hang
+func oneShotNodeNames(client communicator.ConsulClient) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), oneShotConsulTimeout)
+	defer cancel()
+	return nodeNames(ctx, client)
+}
@@ -0,0 +1,197 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/dansteen/consuldog/communicator"
+	"github.com/dansteen/consuldog/datadog"
+	"github.com/dansteen/consuldog/services"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// renderCmd represents the render command
+var renderCmd = &cobra.Command{
+	Use:   "render <template_uri>",
+	Short: "Render a template for a service and print the resulting datadog config",
+	Long: `Render a template through the same steps consuldog uses when it generates datadog configs, and print
+the result.  The service to render the template for can be described with flags, read from a JSON file
+(--serviceFile), or read from consul (--consulServiceID).`,
+	Args: cobra.ExactArgs(1),
+	Run:  render,
+}
+
+func init() {
+	RootCmd.AddCommand(renderCmd)
+
+	renderCmd.Flags().String("datadogType", "", "the datadog check type to render the template as (default is the type used by the service's tag for this template, if there is one)")
+	renderCmd.Flags().StringSlice("param", []string{}, "a <key>=<value> parameter to pass to the template (default is the parameters used by the service's monitor for this template, if there is one)")
+	renderCmd.Flags().String("serviceFile", "", "a JSON file describing the service to render the template for (in the same format as a consul service)")
+	renderCmd.Flags().String("consulServiceID", "", "the ID of a service in consul to render the template for.  It is looked up on the first --nodeName (default is the node of the consul agent we are connecting to)")
+	renderCmd.Flags().String("serviceName", "test-service", "the name of the service to render the template for")
+	renderCmd.Flags().String("serviceID", "test-service-ID", "the ID of the service to render the template for")
+	renderCmd.Flags().String("serviceAddress", "127.0.0.1", "the address of the service to render the template for")
+	renderCmd.Flags().Int("servicePort", 9999, "the port of the service to render the template for")
+	renderCmd.Flags().StringSlice("serviceTags", []string{}, "the tags of the service to render the template for")
+	renderCmd.Flags().String("serviceNode", "test-node", "the node of the service to render the template for")
+	renderCmd.Flags().String("serviceNodeAddress", "127.0.0.1", "the address of the node of the service to render the template for")
+	renderCmd.Flags().String("serviceDatacenter", "test-dc", "the datacenter of the service to render the template for")
+}
+
+func render(cmd *cobra.Command, args []string) {
+	// we always want to look at the latest version of our templates
+	viper.Set("templateCacheTTL", 0)
+	uri := args[0]
+	// consul is only contacted if we need a service or KV values from it
+	client := communicator.NewConsulClient(consulConfig())
+	service, err := renderService(cmd, client)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	monitor := services.Monitor{
+		ConfigTemplate: uri,
+		Params:         make(map[string]string),
+		Service:        &service,
+	}
+	// start with the settings the service uses for this template, if it has any
+	for _, serviceMonitor := range service.Monitors {
+		if serviceMonitor.ConfigTemplate == uri {
+			monitor.DatadogType = serviceMonitor.DatadogType
+			monitor.Params = serviceMonitor.Params
+		}
+	}
+	// and then apply anything we were given
+	if datadogType, _ := cmd.Flags().GetString("datadogType"); datadogType != "" {
+		monitor.DatadogType = datadogType
+	}
+	if params, _ := cmd.Flags().GetStringSlice("param"); len(params) > 0 {
+		monitor.Params = make(map[string]string)
+		for _, param := range params {
+			parts := strings.SplitN(param, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				fmt.Fprintf(os.Stderr, "Parameter '%s' is not in the form <key>=<value>\n", param)
+				os.Exit(1)
+			}
+			monitor.Params[parts[0]] = parts[1]
+		}
+	}
+
+	// load and render our template just like we would when writing configs
+	tmpl, err := datadog.ParseTemplate(uri)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	rendered, err := datadog.ValidateTemplate(tmpl, monitor.DatadogType)
+	if err != nil {
+		renderFailed("Template failed to render for a test service", err, rendered)
+	}
+	config, rendered, err := datadog.RenderMonitor(tmpl, &monitor, datadog.NewKeyLookup(&client))
+	if err != nil {
+		renderFailed(fmt.Sprintf("Template failed to render for service %s", service.ID), err, rendered)
+	}
+
+	configBytes, err := yaml.Marshal(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(string(configBytes))
+}
+
+// renderService works out the service we should render our template for from our flags
+func renderService(cmd *cobra.Command, client communicator.ConsulClient) (services.Service, error) {
+	// a service from consul wins over everything else
+	if consulServiceID, _ := cmd.Flags().GetString("consulServiceID"); consulServiceID != "" {
+		nodes, err := oneShotNodeNames(client)
+		if err != nil {
+			return services.Service{}, err
+		}
+		return client.GetService(nodes[0], consulServiceID)
+	}
+
+	// then a service from a file
+	if serviceFile, _ := cmd.Flags().GetString("serviceFile"); serviceFile != "" {
+		var service services.Service
+		serviceBytes, err := ioutil.ReadFile(serviceFile)
+		if err != nil {
+			return service, err
+		}
+		err = json.Unmarshal(serviceBytes, &service)
+		if err != nil {
+			return service, fmt.Errorf("could not read service from %s: %v", serviceFile, err)
+		}
+		return service, nil
+	}
+
+	// and finally the service described by our flags
+	name, _ := cmd.Flags().GetString("serviceName")
+	id, _ := cmd.Flags().GetString("serviceID")
+	address, _ := cmd.Flags().GetString("serviceAddress")
+	port, _ := cmd.Flags().GetInt("servicePort")
+	tags, _ := cmd.Flags().GetStringSlice("serviceTags")
+	node, _ := cmd.Flags().GetString("serviceNode")
+	nodeAddress, _ := cmd.Flags().GetString("serviceNodeAddress")
+	datacenter, _ := cmd.Flags().GetString("serviceDatacenter")
+	return services.Service{
+		AgentService: consul.AgentService{
+			ID:      id,
+			Service: name,
+			Address: address,
+			Port:    port,
+			Tags:    tags,
+		},
+		Node: node,
+		NodeInfo: consul.Node{
+			Node:       node,
+			Address:    nodeAddress,
+			Datacenter: datacenter,
+		},
+	}, nil
+}
+
+// renderFailed prints err along with whatever the template rendered (so the lines in any yaml errors can be found) and
+// exits
+func renderFailed(message string, err error, rendered []byte) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", message, err)
+	if len(rendered) > 0 {
+		fmt.Fprintln(os.Stderr, "Rendered template:")
+		printNumbered(os.Stderr, rendered)
+	}
+	os.Exit(1)
+}
+
+// printNumbered writes content to out with a line number in front of each line
+func printNumbered(out io.Writer, content []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	line := 1
+	for scanner.Scan() {
+		fmt.Fprintf(out, "%4d | %s\n", line, scanner.Text())
+		line++
+	}
+}
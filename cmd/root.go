@@ -16,7 +16,12 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strconv"
 
+	"github.com/dansteen/consuldog/communicator"
+	"github.com/dansteen/consuldog/datadog"
+	"github.com/dansteen/consuldog/services"
+	consul "github.com/hashicorp/consul/api"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -48,16 +53,68 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 	RootCmd.PersistentFlags().StringP("tempFolder", "t", "/tmp", "the folder to download temporary files to")
+	RootCmd.PersistentFlags().String("templateCacheFolder", "", "the folder to keep copies of downloaded templates in so they can still be used if their host is unavailable (default is a consuldog-templates-<uid> folder inside tempFolder)")
+	RootCmd.PersistentFlags().Int64("templateCacheTTL", 60, "the number of seconds a downloaded template is used for before we check for a new version")
 	RootCmd.PersistentFlags().StringP("datadogFolder", "d", "/etc/dd-agent", "the base datadog config folder (the one containing the datadog.conf file)")
-	RootCmd.PersistentFlags().StringP("datadogProcName", "k", "supervisord", "the name of the datadog process we should send reload signals to.  A process with this name, that is running as the same user as consuldog (if one can be found) will be sent a HUP signal when new datadog configs are written.")
+	RootCmd.PersistentFlags().String("datadogLayout", "agent5", "the layout to write datadog config files in.  'agent5' writes one conf.d/<type>.yaml file per check.  'agent6' writes one conf.d/<type>.d/consuldog-<service id>.yaml file per service")
+	RootCmd.PersistentFlags().StringP("datadogProcName", "k", "supervisord", "the name of the datadog process we should send reload signals to when reloadStrategy is 'signal'.  A process with this name, that is running as the same user as consuldog (if one can be found) will be sent a HUP signal when new datadog configs are written.")
+	RootCmd.PersistentFlags().String("reloadStrategy", "signal", "how to get datadog to pick up new configs.  One of 'signal' (send a HUP signal to the processes named datadogProcName), 'pidfile' (send a HUP signal to the process in datadogPidFile), 'command' (run reloadCommand) or 'http' (make a request to reloadURL)")
+	RootCmd.PersistentFlags().String("datadogProcCmdline", "", "a regular expression for the full command line of the datadog processes to send reload signals to when reloadStrategy is 'signal'.  Takes the place of datadogProcName")
+	RootCmd.PersistentFlags().String("datadogProcExe", "", "a regular expression for the path of the executable of the datadog processes to send reload signals to when reloadStrategy is 'signal'.  Takes the place of datadogProcName")
+	RootCmd.PersistentFlags().String("datadogProcCgroup", "", "a regular expression that a line of the cgroup file of the datadog processes to send reload signals to must match (e.g. 'datadog-agent.service')")
+	RootCmd.PersistentFlags().Int("datadogProcParent", 0, "only send reload signals to datadog processes started by this pid (e.g. 1 to skip processes started by another datadog process)")
+	RootCmd.PersistentFlags().Bool("datadogProcAnyUser", false, "send reload signals to datadog processes owned by any user rather than just the user consuldog is running as.  consuldog needs to be allowed to signal them")
+	RootCmd.PersistentFlags().String("verifyCommand", "", "a command to run after datadog is reloaded to make sure it loaded every check consuldog generated a config for (e.g. 'datadog-agent configcheck' or 'datadog-agent status').  Checks that did not load are logged")
+	RootCmd.PersistentFlags().Int64("verifyDelay", 10, "the number of seconds to wait after reloading datadog before running verifyCommand")
+	RootCmd.PersistentFlags().String("procRoot", "/proc", "the folder proc is mounted on.  Useful when running in a container with the host's proc mounted elsewhere")
+	RootCmd.PersistentFlags().String("datadogPidFile", "", "the pid file of the datadog process to send reload signals to when reloadStrategy is 'pidfile'")
+	RootCmd.PersistentFlags().String("reloadCommand", "", "the command to run to reload datadog when reloadStrategy is 'command' (e.g. 'systemctl reload datadog-agent').  It is run with /bin/sh")
+	RootCmd.PersistentFlags().String("reloadURL", "", "the url to request to reload datadog when reloadStrategy is 'http'")
+	RootCmd.PersistentFlags().String("reloadMethod", "POST", "the http method to use with reloadURL")
+	RootCmd.PersistentFlags().Int64("reloadTimeout", 30, "the number of seconds a reloadCommand, reloadURL request or verifyCommand can take before we give up on it")
 	RootCmd.PersistentFlags().StringP("prefix", "p", "consuldogConfig ", "the consul tag prefix to look for in consul to know that a service needs monitoring")
-	RootCmd.PersistentFlags().StringP("consulAddress", "a", "http://localhost:8500", "the address of the consul agent")
+	RootCmd.PersistentFlags().String("metaPrefix", "consuldog-", "the prefix of the consul service metadata keys that define monitors.  Each monitor is defined by <metaPrefix><n>-template and <metaPrefix><n>-type keys, along with any optional <metaPrefix><n>-<parameter> keys")
+	RootCmd.PersistentFlags().StringP("consulAddress", "a", "", "the address of the consul agent (default is $CONSUL_HTTP_ADDR, or http://localhost:8500)")
+	RootCmd.PersistentFlags().String("consulToken", "", "the ACL token to use with consul (default is $CONSUL_HTTP_TOKEN).  Prefer consulTokenFile since this is visible in the process list")
+	RootCmd.PersistentFlags().String("consulTokenFile", "", "a file containing the ACL token to use with consul")
+	RootCmd.PersistentFlags().String("consulCACert", "", "the CA certificate file to verify consul with when using https (default is $CONSUL_CACERT)")
+	RootCmd.PersistentFlags().String("consulClientCert", "", "the client certificate file to present to consul when using https (default is $CONSUL_CLIENT_CERT)")
+	RootCmd.PersistentFlags().String("consulClientKey", "", "the key for consulClientCert (default is $CONSUL_CLIENT_KEY)")
+	RootCmd.PersistentFlags().String("consulTLSServerName", "", "the server name to expect on consul's certificate (default is $CONSUL_TLS_SERVER_NAME)")
+	RootCmd.PersistentFlags().Bool("consulTLSSkipVerify", false, "do not verify consul's certificate when using https.  Only use this for testing")
 	RootCmd.PersistentFlags().Int64P("datadogMinReloadInterval", "m", 10, "the minimum number of seconds between reloads of the DataDog process regardless of how many times the configs are updated in that time.")
+	RootCmd.PersistentFlags().Int64("renderQuietPeriod", 2, "the number of seconds consul has to be quiet for before we generate new datadog configs, so that a burst of changes only generates them once")
+	RootCmd.PersistentFlags().Int64("renderMaxWait", 10, "the maximum number of seconds we wait for consul to be quiet before generating new datadog configs anyway")
 	RootCmd.PersistentFlags().StringSliceP("nodeName", "n", []string{}, "the name of the node we want to look at the services of (default is the name of the node of the consul agent we are connecting to)")
+	RootCmd.PersistentFlags().String("healthMode", "ignore", "how to treat services whose consul health checks are failing.  One of 'ignore' (monitor them anyway), 'skip' (leave them out of the datadog configs), or 'tag' (add a consul_health:<status> tag to their instances)")
+	RootCmd.PersistentFlags().Bool("strictInitConfig", false, "refuse to write a datadog config file when the services in it disagree on its init_config settings.  The existing file is left alone.  By default the conflict is logged and the first service (by service ID) wins")
+	RootCmd.PersistentFlags().Bool("instanceTags", false, "add consul_service, consul_node, consul_service_id and datacenter tags to every instance in the datadog configs.  Tags a template already sets are not duplicated")
+	RootCmd.PersistentFlags().StringSlice("instanceTagPatterns", []string{}, "regular expressions for the consul service tags that are added to every instance as they are when instanceTags is set (e.g. '^env=')")
+	RootCmd.PersistentFlags().StringSlice("instanceMetaPatterns", []string{}, "regular expressions for the consul service metadata keys that are added to every instance as <key>:<value> tags when instanceTags is set (e.g. '^team$')")
+	RootCmd.PersistentFlags().String("configFileMode", "0640", "the permissions (in octal) that new datadog config files are written with.  Files that already exist keep their permissions")
+	RootCmd.PersistentFlags().String("templateEnvPrefix", "CONSULDOG_TEMPLATE_", "the prefix of the environment variables that templates can read with env.  Templates can't read any other environment variables, and setting this to nothing stops them reading any at all")
+	RootCmd.PersistentFlags().String("kvPrefix", "", "the consul KV path that templates are allowed to read under (e.g. 'monitoring/').  By default templates can read anything our consul token can")
+	RootCmd.PersistentFlags().String("healthThreshold", "critical", "the consul health status at which a service is considered unhealthy when healthMode is not 'ignore'.  Either 'critical' or 'warning'")
+
+	RootCmd.PersistentFlags().Bool("once", false, "render the datadog configs once from the current state of consul and exit rather than watching for changes (the same as the 'once' command)")
 
 	RootCmd.PersistentFlags().Bool("version", false, "Print the version and exit")
 }
 
+// consulConfig gathers the settings we use to connect to consul from our flags and config
+func consulConfig() communicator.ConsulConfig {
+	return communicator.ConsulConfig{
+		Address:       viper.GetString("consulAddress"),
+		Token:         viper.GetString("consulToken"),
+		TokenFile:     viper.GetString("consulTokenFile"),
+		CACert:        viper.GetString("consulCACert"),
+		ClientCert:    viper.GetString("consulClientCert"),
+		ClientKey:     viper.GetString("consulClientKey"),
+		TLSServerName: viper.GetString("consulTLSServerName"),
+		TLSSkipVerify: viper.GetBool("consulTLSSkipVerify"),
+	}
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	viper.AutomaticEnv() // read in environment variables that match
@@ -78,4 +135,43 @@ func initConfig() {
 		fmt.Println(PrettyVersion(GetVersionParts()))
 		os.Exit(0)
 	}
+
+	// make sure our settings make sense before we start
+	switch viper.GetString("datadogLayout") {
+	case datadog.LayoutAgent5, datadog.LayoutAgent6:
+	default:
+		fmt.Printf("Invalid datadogLayout '%s'. Must be either 'agent5' or 'agent6'.\n", viper.GetString("datadogLayout"))
+		os.Exit(1)
+	}
+	switch viper.GetString("healthMode") {
+	case services.HealthModeIgnore, services.HealthModeSkip, services.HealthModeTag:
+	default:
+		fmt.Printf("Invalid healthMode '%s'. Must be one of 'ignore', 'skip' or 'tag'.\n", viper.GetString("healthMode"))
+		os.Exit(1)
+	}
+	switch viper.GetString("healthThreshold") {
+	case consul.HealthCritical, consul.HealthWarning:
+	default:
+		fmt.Printf("Invalid healthThreshold '%s'. Must be either 'critical' or 'warning'.\n", viper.GetString("healthThreshold"))
+		os.Exit(1)
+	}
+	if mode, err := strconv.ParseUint(viper.GetString("configFileMode"), 8, 32); err != nil || mode > 0777 {
+		fmt.Printf("Invalid configFileMode '%s'. Must be file permissions in octal (e.g. 0640).\n", viper.GetString("configFileMode"))
+		os.Exit(1)
+	}
+	for _, setting := range []string{"instanceTagPatterns", "instanceMetaPatterns"} {
+		if _, err := datadog.CompilePatterns(viper.GetStringSlice(setting)); err != nil {
+			fmt.Printf("Invalid %s: %v.\n", setting, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// checkReloadSettings makes sure we know how to reload datadog.  Only the commands that actually reload datadog check
+// this, so that a CI job that just renders or validates templates doesn't need working reload settings
+func checkReloadSettings() {
+	if _, err := datadog.NewReloadStrategy(); err != nil {
+		fmt.Printf("Invalid reload settings: %v.\n", err)
+		os.Exit(1)
+	}
 }
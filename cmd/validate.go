@@ -0,0 +1,123 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dansteen/consuldog/datadog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:   "validate <template_uri_or_folder>...",
+	Short: "Validate templates and report any problems as JSON",
+	Long: `Validate checks templates the same way consuldog does before it uses them, along with some stricter
+checks for things that would otherwise be silently ignored.  Folders are searched for template files.  The
+results are printed as JSON, and the exit code is non-zero if any template has a problem.`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  validate,
+}
+
+// validationResults is the JSON document printed by the validate command
+type validationResults struct {
+	Valid     bool                         `json:"valid"`
+	Templates []datadog.TemplateValidation `json:"templates"`
+}
+
+func init() {
+	RootCmd.AddCommand(validateCmd)
+
+	validateCmd.Flags().String("datadogType", "", "the datadog check type to validate the templates as")
+}
+
+func validate(cmd *cobra.Command, args []string) {
+	// we always want to look at the latest version of our templates
+	viper.Set("templateCacheTTL", 0)
+	datadogType, _ := cmd.Flags().GetString("datadogType")
+	results := validationResults{
+		Valid:     true,
+		Templates: make([]datadog.TemplateValidation, 0),
+	}
+
+	for _, uri := range validateURIs(args) {
+		validation := datadog.LintTemplate(uri, datadogType)
+		if !validation.Valid {
+			results.Valid = false
+		}
+		results.Templates = append(results.Templates, validation)
+	}
+
+	// templates are full of <, > and & so we don't want them escaped
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(results)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !results.Valid {
+		os.Exit(1)
+	}
+}
+
+// validateURIs turns our arguments into a list of template uris.  Local files are turned into file:// uris and local
+// folders are searched for files.  Anything else is assumed to be a uri already
+func validateURIs(args []string) []string {
+	uris := make([]string, 0)
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			uris = append(uris, arg)
+			continue
+		}
+		if !info.IsDir() {
+			uris = append(uris, fileURI(arg))
+			continue
+		}
+		filepath.Walk(arg, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			// skip hidden files and folders (such as .git)
+			if strings.HasPrefix(info.Name(), ".") && filePath != arg {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.IsDir() {
+				uris = append(uris, fileURI(filePath))
+			}
+			return nil
+		})
+	}
+	return uris
+}
+
+// fileURI returns a file:// uri for the local file at filePath
+func fileURI(filePath string) string {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		absPath = filePath
+	}
+	return fmt.Sprintf("file://%s", absPath)
+}
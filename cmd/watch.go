@@ -14,7 +14,14 @@
 package cmd
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/dansteen/consuldog/communicator"
 	"github.com/dansteen/consuldog/datadog"
@@ -47,29 +54,116 @@ func init() {
 }
 
 func watch(cmd *cobra.Command, args []string) {
-	client := communicator.NewConsulClient(viper.GetString("consulAddress"))
+	// if we only want to render once we don't need to set any of our watches up
+	if viper.GetBool("once") {
+		once(cmd, args)
+		return
+	}
+	checkReloadSettings()
+
+	// we shut down cleanly when asked to
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+
+	client := communicator.NewConsulClient(consulConfig())
 	newServices := make(chan services.NodeServices, 5)
-	stop := make(chan bool)
 	// we need to gather our services by node
 	allServices := services.NewServices()
 
-	// set up some chans and run our reloader so we can reload datadog when needed
-	triggerReload := make(chan bool)
-	go datadog.Reloader(triggerReload, stop)
+	// set up some chans and run our reloader so we can reload datadog when needed.  The reloader gets its own context
+	// since it needs to keep going until we have finished writing our configs
+	reloaderCtx, stopReloader := context.WithCancel(context.Background())
+	triggerReload := make(chan bool, 1)
+	reloaderDone := make(chan bool)
+	go func() {
+		datadog.Reloader(reloaderCtx, triggerReload)
+		close(reloaderDone)
+	}()
+	// once we are done, let the reloader flush any pending reload and wait for it to finish
+	defer func() {
+		stopReloader()
+		<-reloaderDone
+		log.Println("Shutdown complete")
+	}()
 
-	var nodeNames []string
-	// get our list of nodes or, if its not set, use the nodename of the agent we are connecting to
-	if len(viper.GetStringSlice("nodeName")) > 0 {
-		nodeNames = viper.GetStringSlice("nodeName")
-	} else {
-		log.Printf("%s", "No nodeName specified.  Reading it from provided agent....")
-		nodeNames = []string{client.GetNodeName()}
-		log.Printf("Using '%s'", nodeNames[0])
+	nodes, err := nodeNames(ctx, client)
+	if err != nil {
+		return
 	}
 	// then run a thread for each node we are monitoring
-	for _, node := range nodeNames {
-		go client.MonitorNode(node, newServices, stop)
+	var monitors sync.WaitGroup
+	for _, node := range nodes {
+		monitors.Add(1)
+		go func(node string) {
+			defer monitors.Done()
+			client.MonitorNode(ctx, node, newServices)
+		}(node)
+	}
+	// our templates can read from the consul KV store, so we need to render them again whenever the keys they read
+	// change.  The keys we watch are replaced whenever the set of keys our templates read changes
+	keysChanged := make(chan bool, 1)
+	var keyWatches sync.WaitGroup
+	defer keyWatches.Wait()
+	var watchedKeys datadog.KeyDependencies
+	stopKeyWatches := func() {}
+	writeConfig := func(snapshot services.Services) {
+		// datadog only needs to be reloaded if we actually changed something.  Any problems have already been
+		// logged, and will be retried the next time things change
+		changed, dependencies, _ := datadog.WriteConfig(snapshot, &client)
+		if len(changed) > 0 {
+			requestReload(triggerReload)
+		}
+		if reflect.DeepEqual(dependencies, watchedKeys) {
+			return
+		}
+		stopKeyWatches()
+		watchedKeys = dependencies
+		keyCtx, cancelKeys := context.WithCancel(ctx)
+		stopKeyWatches = cancelKeys
+		keyWatches.Add(1)
+		go func() {
+			defer keyWatches.Done()
+			client.WatchKeys(keyCtx, dependencies.Keys, dependencies.Prefixes, keysChanged)
+		}()
+	}
+
+	// rendering happens on its own so that a slow template host can't stop us from keeping up with consul.  It works
+	// on a copy of our services, and only the latest copy is ever waiting to be rendered
+	pendingRender := make(chan services.Services, 1)
+	renderDone := make(chan bool)
+	go func() {
+		defer close(renderDone)
+		for snapshot := range pendingRender {
+			writeConfig(snapshot)
+		}
+		// nothing else will be rendered so we don't need to watch any keys
+		stopKeyWatches()
+	}()
+
+	// changes tend to come in bursts (e.g. when a deploy touches a lot of services), so rather than rendering for each
+	// one we wait until things have been quiet for renderQuietPeriod.  renderMaxWait makes sure a steady stream of
+	// changes can't hold things up forever.  Both of these are nil while there is nothing waiting to be rendered
+	quietPeriod := time.Duration(viper.GetInt64("renderQuietPeriod")) * time.Second
+	maxWait := time.Duration(viper.GetInt64("renderMaxWait")) * time.Second
+	var quiet, deadline <-chan time.Time
+	scheduleRender := func() {
+		quiet = time.After(quietPeriod)
+		if deadline == nil {
+			deadline = time.After(maxWait)
+		}
+	}
+	render := func() {
+		quiet = nil
+		deadline = nil
+		// anything still waiting to be rendered is out of date, so we replace it
+		select {
+		case <-pendingRender:
+		default:
+		}
+		pendingRender <- allServices.Copy()
 	}
+
 	// listen for new services
 	for {
 		select {
@@ -84,9 +178,60 @@ func watch(cmd *cobra.Command, args []string) {
 				}
 				allServices.Add(service)
 			}
-
-			datadog.WriteConfig(allServices)
-			triggerReload <- true
+			scheduleRender()
+		case <-keysChanged:
+			scheduleRender()
+		case <-quiet:
+			render()
+		case <-deadline:
+			render()
+		case <-ctx.Done():
+			// wait for our consul watches to stop, and then hand anything that was still waiting to be rendered to the
+			// renderer and let it finish up
+			monitors.Wait()
+			if quiet != nil {
+				render()
+			}
+			close(pendingRender)
+			<-renderDone
+			return
 		}
 	}
 }
+
+// requestReload asks the reloader to reload datadog without waiting for it.  If there is already a request waiting,
+// the reload it leads to will pick up our changes as well
+func requestReload(triggerReload chan<- bool) {
+	select {
+	case triggerReload <- true:
+	default:
+	}
+}
+
+// handleSignals will call cancel when we get a SIGTERM or SIGINT.  A second signal stops us right away
+func handleSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		received := <-signals
+		log.Printf("Received %s. Shutting down....\n", received)
+		cancel()
+		received = <-signals
+		log.Printf("Received %s again. Exiting immediately.\n", received)
+		os.Exit(1)
+	}()
+}
+
+// nodeNames returns the list of nodes we should look at or, if its not set, the nodename of the agent we are connecting to
+func nodeNames(ctx context.Context, client communicator.ConsulClient) ([]string, error) {
+	if len(viper.GetStringSlice("nodeName")) > 0 {
+		return viper.GetStringSlice("nodeName"), nil
+	}
+	log.Printf("%s", "No nodeName specified.  Reading it from provided agent....")
+	nodeName, err := client.GetNodeName(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using '%s'", nodeName)
+	return []string{nodeName}, nil
+}
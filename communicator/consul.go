@@ -1,9 +1,16 @@
 package communicator
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dansteen/consuldog/services"
@@ -16,15 +23,56 @@ type ConsulClient struct {
 	client *consul.Client
 }
 
+// ConsulConfig holds the settings we use to connect to consul.  Anything left empty falls back to the standard
+// CONSUL_HTTP_* environment variables, and then to the consul defaults
+type ConsulConfig struct {
+	Address       string
+	Token         string
+	TokenFile     string
+	CACert        string
+	ClientCert    string
+	ClientKey     string
+	TLSServerName string
+	TLSSkipVerify bool
+}
+
 // NewConsulClient will generate a new connection to consul
-func NewConsulClient(consulAddress string) ConsulClient {
+func NewConsulClient(consulConfig ConsulConfig) ConsulClient {
 	// log errors to stderr
 	logger := log.New(os.Stderr, log.Prefix(), 0)
-	// configure our consul client
-	config := consul.Config{
-		Address: consulAddress,
+	// configure our consul client.  The defaults include anything set in the CONSUL_HTTP_* environment variables
+	config := consul.DefaultConfig()
+	if consulConfig.Address != "" {
+		config.Address = consulConfig.Address
+	}
+	if consulConfig.Token != "" {
+		config.Token = consulConfig.Token
+	}
+	// a token file wins over a token since it is the safer of the two
+	if consulConfig.TokenFile != "" {
+		token, err := ioutil.ReadFile(consulConfig.TokenFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		config.Token = strings.TrimSpace(string(token))
+	}
+	if consulConfig.CACert != "" {
+		config.TLSConfig.CAFile = consulConfig.CACert
+	}
+	if consulConfig.ClientCert != "" {
+		config.TLSConfig.CertFile = consulConfig.ClientCert
+	}
+	if consulConfig.ClientKey != "" {
+		config.TLSConfig.KeyFile = consulConfig.ClientKey
 	}
-	consulClient, err := consul.NewClient(&config)
+	if consulConfig.TLSServerName != "" {
+		config.TLSConfig.Address = consulConfig.TLSServerName
+	}
+	if consulConfig.TLSSkipVerify {
+		config.TLSConfig.InsecureSkipVerify = true
+	}
+
+	consulClient, err := consul.NewClient(config)
 	if err != nil {
 		logger.Fatal(err)
 	}
@@ -33,76 +81,356 @@ func NewConsulClient(consulAddress string) ConsulClient {
 	}
 }
 
+// HealthAware returns true if we have been asked to take the health of services into account
+func HealthAware() bool {
+	return viper.GetString("healthMode") != services.HealthModeIgnore
+}
+
 // MonitorNode will monitor consul for changes in a node and, on changes, send back a list of service for that node
-// that match our prefix
-func (consulClient *ConsulClient) MonitorNode(node string, serviceOut chan<- services.NodeServices, cont <-chan bool) {
+// that match our prefix.  It keeps going until ctx is cancelled, at which point any queries that are waiting on consul
+// are cancelled as well
+func (consulClient *ConsulClient) MonitorNode(ctx context.Context, node string, serviceOut chan<- services.NodeServices) {
 	// log errors to stderr
 	logger := log.New(os.Stderr, log.Prefix(), 0)
-	// grab our catalog connection
+	// grab our catalog and health connections
 	catalog := consulClient.client.Catalog()
-	// we want to return right away the first time so we get an initial set of services
-	lastIndex := uint64(0)
+	health := consulClient.client.Health()
+	// changes to the catalog (and to the health checks if we care about them) are funneled through here.  We always
+	// read the full state of the node when it fires so it never needs to hold more than one value
+	changed := make(chan bool, 1)
+	// we don't return until all of our watches have
+	var watches sync.WaitGroup
+	defer watches.Wait()
+
+	watches.Add(1)
+	go func() {
+		defer watches.Done()
+		watchIndex(ctx, func(waitIndex uint64) (uint64, error) {
+			_, meta, err := catalog.Node(node, (&consul.QueryOptions{
+				AllowStale: true,
+				WaitIndex:  waitIndex,
+			}).WithContext(ctx))
+			if err != nil {
+				return 0, err
+			}
+			return meta.LastIndex, nil
+		}, changed)
+	}()
+	// health checks have their own index in consul so we need a separate watch for them
+	if HealthAware() {
+		watches.Add(1)
+		go func() {
+			defer watches.Done()
+			watchIndex(ctx, func(waitIndex uint64) (uint64, error) {
+				_, meta, err := health.Node(node, (&consul.QueryOptions{
+					AllowStale: true,
+					WaitIndex:  waitIndex,
+				}).WithContext(ctx))
+				if err != nil {
+					return 0, err
+				}
+				return meta.LastIndex, nil
+			}, changed)
+		}()
+	}
+
 	// keep going until we are told to stop
 	for {
 		select {
-		case <-cont:
+		case <-ctx.Done():
 			return
-		default:
-			node, meta, err := catalog.Node(node, &consul.QueryOptions{
-				AllowStale: true,
-				WaitIndex:  lastIndex,
-			})
+		case <-changed:
+			foundServices, err := consulClient.NodeServices(node)
 			// if we get an error we wait and then try again
 			if err != nil {
 				logger.Println(err)
-				time.Sleep(5 * time.Second)
-			} else {
-				if lastIndex != meta.LastIndex {
-					lastIndex = meta.LastIndex
-					// create our NodeServices object
-					foundServices := services.NodeServices{
-						Node:     node.Node.Node,
-						Services: make([]services.Service, 0),
-					}
-
-					// create a list of services to be monitored
-					for _, service := range node.Services {
-						// generate our service
-						var newService services.Service
-						newService = services.Service{
-							Monitors:     make([]services.Monitor, 0),
-							AgentService: *service,
-							Node:         node.Node.Node,
-						}
-
-						// grab our tags that have our prefix
-						for _, tag := range service.Tags {
-							if strings.HasPrefix(tag, viper.GetString("prefix")) {
-								// parse our values
-								values := strings.SplitN(strings.TrimPrefix(tag, viper.GetString("prefix")), " ", 2)
-								// and create monitors for them
-								newService.Monitors = append(newService.Monitors, services.Monitor{
-									ConfigTemplate: values[0],
-									DatadogType:    values[1],
-									Service:        &newService,
-								})
-							}
-						}
-						// if we found monitors, add that service to our list
-						if len(newService.Monitors) > 0 {
-							foundServices.Services = append(foundServices.Services, newService)
-						}
-					}
-					// we always return if there was an updat since we need to know if services were removed
-					serviceOut <- foundServices
+				if !sleep(ctx, 5*time.Second) {
+					return
 				}
+				notify(changed)
+				continue
+			}
+			// we always return if there was an update since we need to know if services were removed
+			select {
+			case serviceOut <- foundServices:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// watchIndex will run a blocking query over and over and send a value on changed each time the index it returns
+// moves.  It keeps going until ctx is cancelled
+func watchIndex(ctx context.Context, query func(waitIndex uint64) (uint64, error), changed chan<- bool) {
+	// log errors to stderr
+	logger := log.New(os.Stderr, log.Prefix(), 0)
+	// we want to return right away the first time so we get an initial set of services
+	lastIndex := uint64(0)
+	// keep going until we are told to stop
+	for ctx.Err() == nil {
+		index, err := query(lastIndex)
+		// if we get an error we wait and then try again
+		if err != nil {
+			// errors caused by us shutting down are expected
+			if ctx.Err() != nil {
+				return
 			}
+			logger.Println(err)
+			sleep(ctx, 5*time.Second)
+		} else if lastIndex != index {
+			lastIndex = index
+			notify(changed)
 		}
 	}
 }
 
-// GetNodeName will get the node name of the consul agent we have connected to
-func (consulClient *ConsulClient) GetNodeName() string {
+// sleep waits for duration, or until ctx is cancelled.  It returns false if ctx was cancelled
+func sleep(ctx context.Context, duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// notify will send a value on changed without blocking.  If there is already a value waiting then whoever is
+// listening has not caught up yet and will see our change when it does
+func notify(changed chan<- bool) {
+	select {
+	case changed <- true:
+	default:
+	}
+}
+
+// NodeServices will read the current services for a node from consul and return the ones that match our prefix.  If
+// we are health aware, the health of each service is filled in as well
+func (consulClient *ConsulClient) NodeServices(nodeName string) (services.NodeServices, error) {
+	// create our NodeServices object
+	foundServices := services.NodeServices{
+		Node:     nodeName,
+		Services: make([]services.Service, 0),
+	}
+
+	node, _, err := consulClient.client.Catalog().Node(nodeName, &consul.QueryOptions{
+		AllowStale: true,
+	})
+	if err != nil {
+		return foundServices, err
+	}
+	// if the node is not (or is no longer) in the catalog it has no services
+	if node == nil {
+		return foundServices, nil
+	}
+
+	// grab the health checks for the node if we need them
+	var checks consul.HealthChecks
+	if HealthAware() {
+		checks, _, err = consulClient.client.Health().Node(nodeName, &consul.QueryOptions{
+			AllowStale: true,
+		})
+		if err != nil {
+			return foundServices, err
+		}
+	}
+
+	// create a list of services to be monitored
+	for _, service := range node.Services {
+		newService := buildService(node.Node, service)
+		if HealthAware() {
+			newService.Health = serviceHealth(service.ID, checks)
+		}
+		// if we found monitors, add that service to our list
+		if len(newService.Monitors) > 0 {
+			foundServices.Services = append(foundServices.Services, newService)
+		}
+	}
+	return foundServices, nil
+}
+
+// GetService will read a single service from a node in consul, whether or not it has any monitors
+func (consulClient *ConsulClient) GetService(nodeName string, serviceID string) (services.Service, error) {
+	node, _, err := consulClient.client.Catalog().Node(nodeName, &consul.QueryOptions{
+		AllowStale: true,
+	})
+	if err != nil {
+		return services.Service{}, err
+	}
+	if node == nil {
+		return services.Service{}, fmt.Errorf("node %s was not found in consul", nodeName)
+	}
+	service, found := node.Services[serviceID]
+	if !found {
+		return services.Service{}, fmt.Errorf("service %s was not found on node %s", serviceID, nodeName)
+	}
+	return buildService(node.Node, service), nil
+}
+
+// buildService generates our service from a consul service, along with monitors for each of its tags that have our
+// prefix and each of the monitor definitions in its metadata
+func buildService(node *consul.Node, service *consul.AgentService) services.Service {
+	// log errors to stderr
+	logger := log.New(os.Stderr, log.Prefix(), 0)
+	// generate our service
+	newService := services.Service{
+		Monitors:     make([]services.Monitor, 0),
+		AgentService: *service,
+		Node:         node.Node,
+		NodeInfo:     *node,
+	}
+
+	// grab our tags that have our prefix
+	for _, tag := range service.Tags {
+		if strings.HasPrefix(tag, viper.GetString("prefix")) {
+			monitor, err := parseMonitorTag(strings.TrimPrefix(tag, viper.GetString("prefix")))
+			if err != nil {
+				logger.Printf("Service %s has a malformed monitor tag '%s': %v. Skipping.\n", service.ID, tag, err)
+				continue
+			}
+			monitor.Service = &newService
+			newService.Monitors = append(newService.Monitors, monitor)
+		}
+	}
+
+	// then any monitors defined in our metadata
+	metaMonitors, errs := parseMonitorMeta(service.Meta)
+	for _, err := range errs {
+		logger.Printf("Service %s has a malformed monitor definition in its metadata: %v. Skipping.\n", service.ID, err)
+	}
+	for _, monitor := range metaMonitors {
+		monitor.Service = &newService
+		newService.Monitors = append(newService.Monitors, monitor)
+	}
+	return newService
+}
+
+// parseMonitorTag will create a monitor from the part of a tag that follows our prefix, which should be in the form
+// <template_uri> <datadog_type> [<key>=<value> ...]
+func parseMonitorTag(definition string) (services.Monitor, error) {
+	values := strings.Fields(definition)
+	if len(values) < 2 {
+		return services.Monitor{}, fmt.Errorf("expected '<template_uri> <datadog_type> [<key>=<value> ...]'")
+	}
+	err := checkDatadogType(values[1])
+	if err != nil {
+		return services.Monitor{}, err
+	}
+	monitor := services.Monitor{
+		ConfigTemplate: values[0],
+		DatadogType:    values[1],
+		Params:         make(map[string]string),
+	}
+	// anything after the type is a parameter for the template
+	for _, param := range values[2:] {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return services.Monitor{}, fmt.Errorf("parameter '%s' is not in the form <key>=<value>", param)
+		}
+		monitor.Params[parts[0]] = parts[1]
+	}
+	return monitor, nil
+}
+
+// parseMonitorMeta will create monitors from service metadata.  Each monitor is made up of keys in the form
+// <metaPrefix><n>-<setting> that share the same n.  The template and type settings are required, and any other
+// settings are stored as parameters for the monitor
+func parseMonitorMeta(meta map[string]string) ([]services.Monitor, []error) {
+	metaPrefix := viper.GetString("metaPrefix")
+	errs := make([]error, 0)
+
+	// gather our settings up by monitor
+	definitions := make(map[string]map[string]string)
+	for key, value := range meta {
+		if !strings.HasPrefix(key, metaPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(key, metaPrefix), "-", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			errs = append(errs, fmt.Errorf("key '%s' is not in the form %s<n>-<setting>", key, metaPrefix))
+			continue
+		}
+		if _, found := definitions[parts[0]]; !found {
+			definitions[parts[0]] = make(map[string]string)
+		}
+		definitions[parts[0]][parts[1]] = value
+	}
+
+	// we want our monitors in a consistent order
+	ids := make([]string, 0, len(definitions))
+	for id := range definitions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		iNum, iErr := strconv.Atoi(ids[i])
+		jNum, jErr := strconv.Atoi(ids[j])
+		if iErr == nil && jErr == nil {
+			return iNum < jNum
+		}
+		return ids[i] < ids[j]
+	})
+
+	monitors := make([]services.Monitor, 0, len(definitions))
+	for _, id := range ids {
+		settings := definitions[id]
+		if settings["template"] == "" || settings["type"] == "" {
+			errs = append(errs, fmt.Errorf("monitor %s needs both %s%s-template and %s%s-type", id, metaPrefix, id, metaPrefix, id))
+			continue
+		}
+		err := checkDatadogType(settings["type"])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("monitor %s: %v", id, err))
+			continue
+		}
+		monitor := services.Monitor{
+			ConfigTemplate: settings["template"],
+			DatadogType:    settings["type"],
+			Params:         make(map[string]string),
+		}
+		for setting, value := range settings {
+			if setting != "template" && setting != "type" {
+				monitor.Params[setting] = value
+			}
+		}
+		monitors = append(monitors, monitor)
+	}
+	return monitors, errs
+}
+
+// datadogTypePattern matches the datadog types we accept.  The type ends up in the names of the files and folders we
+// write, so anything that could take us outside of conf.d is turned away
+var datadogTypePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// checkDatadogType makes sure datadogType is safe to use in a file name
+func checkDatadogType(datadogType string) error {
+	if !datadogTypePattern.MatchString(datadogType) || datadogType == "." || datadogType == ".." {
+		return fmt.Errorf("datadog type '%s' may only contain letters, numbers, '_', '.' and '-'", datadogType)
+	}
+	return nil
+}
+
+// serviceHealth works out the overall health of a service from its own checks and the checks on its node.  Just
+// like consul does, the worst status wins
+func serviceHealth(serviceID string, checks consul.HealthChecks) string {
+	status := consul.HealthPassing
+	for _, check := range checks {
+		// node checks (which have no service ID) apply to every service on the node
+		if check.ServiceID != "" && check.ServiceID != serviceID {
+			continue
+		}
+		switch check.Status {
+		case consul.HealthCritical:
+			return consul.HealthCritical
+		case consul.HealthWarning:
+			status = consul.HealthWarning
+		}
+	}
+	return status
+}
+
+// GetNodeName will get the node name of the consul agent we have connected to.  It keeps trying until it succeeds or
+// ctx is done, in which case the last error we got from consul is returned
+func (consulClient *ConsulClient) GetNodeName(ctx context.Context) (string, error) {
 	// log errors to stderr
 	logger := log.New(os.Stderr, log.Prefix(), 0)
 	// we keep trying to connect
@@ -111,8 +439,86 @@ func (consulClient *ConsulClient) GetNodeName() string {
 		if err != nil {
 			logger.Println(err)
 		} else {
-			return nodeName
+			return nodeName, nil
+		}
+		if !sleep(ctx, 5*time.Second) {
+			return "", fmt.Errorf("could not read the node name from consul: %v", err)
+		}
+	}
+}
+
+// Key returns the value stored at path in the consul KV store, and whether there was anything there at all
+func (consulClient *ConsulClient) Key(path string) (string, bool, error) {
+	pair, _, err := consulClient.client.KV().Get(path, &consul.QueryOptions{
+		AllowStale: true,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if pair == nil {
+		return "", false, nil
+	}
+	return string(pair.Value), true, nil
+}
+
+// Tree returns every key under prefix in the consul KV store (with prefix removed) along with its value.  Folders are
+// left out since they have no value of their own
+func (consulClient *ConsulClient) Tree(prefix string) (map[string]string, error) {
+	pairs, _, err := consulClient.client.KV().List(prefix, &consul.QueryOptions{
+		AllowStale: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tree := make(map[string]string)
+	for _, pair := range pairs {
+		if strings.HasSuffix(pair.Key, "/") {
+			continue
 		}
-		time.Sleep(5 * time.Second)
+		tree[strings.TrimPrefix(strings.TrimPrefix(pair.Key, prefix), "/")] = string(pair.Value)
+	}
+	return tree, nil
+}
+
+// WatchKeys will watch the consul KV paths in keys, and everything under the paths in prefixes, and send a value on
+// changed whenever any of them change.  Like MonitorNode, it also sends a value once it has read each of them for the
+// first time.  It keeps going until ctx is cancelled
+func (consulClient *ConsulClient) WatchKeys(ctx context.Context, keys []string, prefixes []string, changed chan<- bool) {
+	kv := consulClient.client.KV()
+	// we don't return until all of our watches have
+	var watches sync.WaitGroup
+	defer watches.Wait()
+
+	for _, key := range keys {
+		watches.Add(1)
+		go func(key string) {
+			defer watches.Done()
+			watchIndex(ctx, func(waitIndex uint64) (uint64, error) {
+				_, meta, err := kv.Get(key, (&consul.QueryOptions{
+					AllowStale: true,
+					WaitIndex:  waitIndex,
+				}).WithContext(ctx))
+				if err != nil {
+					return 0, err
+				}
+				return meta.LastIndex, nil
+			}, changed)
+		}(key)
+	}
+	for _, prefix := range prefixes {
+		watches.Add(1)
+		go func(prefix string) {
+			defer watches.Done()
+			watchIndex(ctx, func(waitIndex uint64) (uint64, error) {
+				_, meta, err := kv.List(prefix, (&consul.QueryOptions{
+					AllowStale: true,
+					WaitIndex:  waitIndex,
+				}).WithContext(ctx))
+				if err != nil {
+					return 0, err
+				}
+				return meta.LastIndex, nil
+			}, changed)
+		}(prefix)
 	}
 }
@@ -0,0 +1,246 @@
+package communicator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dansteen/consuldog/services"
+	"github.com/spf13/viper"
+)
+
+func TestParseMonitorTag(t *testing.T) {
+	tests := []struct {
+		name       string
+		definition string
+		expected   services.Monitor
+		err        string
+	}{
+		{
+			name:       "empty tag",
+			definition: "",
+			err:        "expected '<template_uri> <datadog_type>",
+		},
+		{
+			name:       "only whitespace",
+			definition: "   ",
+			err:        "expected '<template_uri> <datadog_type>",
+		},
+		{
+			name:       "template only",
+			definition: "http://templates/apache.yaml",
+			err:        "expected '<template_uri> <datadog_type>",
+		},
+		{
+			name:       "template and type",
+			definition: "http://templates/apache.yaml apache",
+			expected: services.Monitor{
+				ConfigTemplate: "http://templates/apache.yaml",
+				DatadogType:    "apache",
+				Params:         map[string]string{},
+			},
+		},
+		{
+			name:       "parameters",
+			definition: "http://templates/apache.yaml apache path=/status empty= url=http://host/?a=b",
+			expected: services.Monitor{
+				ConfigTemplate: "http://templates/apache.yaml",
+				DatadogType:    "apache",
+				Params:         map[string]string{"path": "/status", "empty": "", "url": "http://host/?a=b"},
+			},
+		},
+		{
+			name:       "parameter without a value",
+			definition: "http://templates/apache.yaml apache path",
+			err:        "parameter 'path' is not in the form <key>=<value>",
+		},
+		{
+			name:       "parameter without a key",
+			definition: "http://templates/apache.yaml apache =/status",
+			err:        "parameter '=/status' is not in the form <key>=<value>",
+		},
+		{
+			name:       "type that leaves conf.d",
+			definition: "http://templates/apache.yaml ../../etc/cron",
+			err:        "datadog type '../../etc/cron'",
+		},
+		{
+			name:       "parent folder type",
+			definition: "http://templates/apache.yaml ..",
+			err:        "datadog type '..'",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			monitor, err := parseMonitorTag(test.definition)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(monitor, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, monitor)
+			}
+		})
+	}
+}
+
+func TestParseMonitorMeta(t *testing.T) {
+	viper.Set("metaPrefix", "consuldog-")
+	defer viper.Set("metaPrefix", nil)
+
+	tests := []struct {
+		name     string
+		meta     map[string]string
+		expected []services.Monitor
+		errs     []string
+	}{
+		{
+			name:     "no metadata",
+			meta:     nil,
+			expected: []services.Monitor{},
+		},
+		{
+			name:     "unrelated keys",
+			meta:     map[string]string{"version": "1.2.3", "team": "web"},
+			expected: []services.Monitor{},
+		},
+		{
+			name: "complete monitor",
+			meta: map[string]string{
+				"consuldog-1-template": "http://templates/apache.yaml",
+				"consuldog-1-type":     "apache",
+				"consuldog-1-path":     "/status",
+			},
+			expected: []services.Monitor{
+				{
+					ConfigTemplate: "http://templates/apache.yaml",
+					DatadogType:    "apache",
+					Params:         map[string]string{"path": "/status"},
+				},
+			},
+		},
+		{
+			name: "missing type",
+			meta: map[string]string{
+				"consuldog-1-template": "http://templates/apache.yaml",
+			},
+			expected: []services.Monitor{},
+			errs:     []string{"monitor 1 needs both consuldog-1-template and consuldog-1-type"},
+		},
+		{
+			name: "missing template",
+			meta: map[string]string{
+				"consuldog-1-type": "apache",
+			},
+			expected: []services.Monitor{},
+			errs:     []string{"monitor 1 needs both consuldog-1-template and consuldog-1-type"},
+		},
+		{
+			name: "key without a setting",
+			meta: map[string]string{
+				"consuldog-1":  "apache",
+				"consuldog-1-": "apache",
+			},
+			expected: []services.Monitor{},
+			errs: []string{
+				"key 'consuldog-1' is not in the form consuldog-<n>-<setting>",
+				"key 'consuldog-1-' is not in the form consuldog-<n>-<setting>",
+			},
+		},
+		{
+			name: "key without a number",
+			meta: map[string]string{
+				"consuldog--type": "apache",
+			},
+			expected: []services.Monitor{},
+			errs:     []string{"key 'consuldog--type' is not in the form consuldog-<n>-<setting>"},
+		},
+		{
+			name: "unsafe type",
+			meta: map[string]string{
+				"consuldog-1-template": "http://templates/apache.yaml",
+				"consuldog-1-type":     "../apache",
+			},
+			expected: []services.Monitor{},
+			errs:     []string{"monitor 1: datadog type '../apache'"},
+		},
+		{
+			name: "bad monitors do not stop good ones",
+			meta: map[string]string{
+				"consuldog-1-template": "http://templates/apache.yaml",
+				"consuldog-2-template": "http://templates/nginx.yaml",
+				"consuldog-2-type":     "nginx",
+			},
+			expected: []services.Monitor{
+				{
+					ConfigTemplate: "http://templates/nginx.yaml",
+					DatadogType:    "nginx",
+					Params:         map[string]string{},
+				},
+			},
+			errs: []string{"monitor 1 needs both"},
+		},
+		{
+			name: "monitors are in numeric order",
+			meta: map[string]string{
+				"consuldog-10-template": "http://templates/ten.yaml",
+				"consuldog-10-type":     "ten",
+				"consuldog-2-template":  "http://templates/two.yaml",
+				"consuldog-2-type":      "two",
+				"consuldog-1-template":  "http://templates/one.yaml",
+				"consuldog-1-type":      "one",
+			},
+			expected: []services.Monitor{
+				{ConfigTemplate: "http://templates/one.yaml", DatadogType: "one", Params: map[string]string{}},
+				{ConfigTemplate: "http://templates/two.yaml", DatadogType: "two", Params: map[string]string{}},
+				{ConfigTemplate: "http://templates/ten.yaml", DatadogType: "ten", Params: map[string]string{}},
+			},
+		},
+		{
+			name: "ids that are not numbers are sorted alphabetically",
+			meta: map[string]string{
+				"consuldog-b-template": "http://templates/b.yaml",
+				"consuldog-b-type":     "b",
+				"consuldog-a-template": "http://templates/a.yaml",
+				"consuldog-a-type":     "a",
+				"consuldog-3-template": "http://templates/three.yaml",
+				"consuldog-3-type":     "three",
+			},
+			expected: []services.Monitor{
+				{ConfigTemplate: "http://templates/three.yaml", DatadogType: "three", Params: map[string]string{}},
+				{ConfigTemplate: "http://templates/a.yaml", DatadogType: "a", Params: map[string]string{}},
+				{ConfigTemplate: "http://templates/b.yaml", DatadogType: "b", Params: map[string]string{}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			monitors, errs := parseMonitorMeta(test.meta)
+			if !reflect.DeepEqual(monitors, test.expected) {
+				t.Errorf("expected monitors %+v, got %+v", test.expected, monitors)
+			}
+			if len(errs) != len(test.errs) {
+				t.Fatalf("expected %d errors, got %v", len(test.errs), errs)
+			}
+			// the errors for malformed keys come out in map order
+			for _, expected := range test.errs {
+				found := false
+				for _, err := range errs {
+					if strings.Contains(err.Error(), expected) {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("expected an error containing %q, got %v", expected, errs)
+				}
+			}
+		})
+	}
+}
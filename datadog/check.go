@@ -1,8 +1,138 @@
 package datadog
 
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dansteen/consuldog/services"
+)
+
 // contains primitives for working with objects that datadog expects
 
 type CheckConf struct {
 	InitConfig map[string]interface{} `yaml:"init_config"`
-	Instances  []interface{}          `yaml:"instances"`
+	Instances  []interface{}          `yaml:"instances,omitempty"`
+	// Logs holds the log collection settings for datadog agent 6 and later
+	Logs []interface{} `yaml:"logs,omitempty"`
+}
+
+// empty checks if a config has nothing for datadog to do
+func (config CheckConf) empty() bool {
+	return len(config.Instances) == 0 && len(config.Logs) == 0
+}
+
+// addInstanceTags will add tags to a check instance, skipping any that the instance already has.  Instances that
+// are not maps (which datadog would not accept anyway) are returned untouched.  Tags given as a single string (e.g.
+// "env:prod, team:web") are turned into a list so we can add to them.  If the instance has tags we don't know how to
+// add to, it is returned untouched along with an error
+func addInstanceTags(instance interface{}, tags []string) (interface{}, error) {
+	instanceMap, ok := instance.(map[interface{}]interface{})
+	if !ok {
+		return instance, nil
+	}
+
+	// gather up the tags we already have so we don't duplicate them
+	var instanceTags []interface{}
+	switch currentTags := instanceMap["tags"].(type) {
+	case nil:
+	case []interface{}:
+		instanceTags = currentTags
+	case string:
+		for _, tag := range strings.Split(currentTags, ",") {
+			if strings.TrimSpace(tag) != "" {
+				instanceTags = append(instanceTags, strings.TrimSpace(tag))
+			}
+		}
+	default:
+		return instance, fmt.Errorf("its tags are not a list (%v)", currentTags)
+	}
+	existing := make(map[string]bool)
+	for _, tag := range instanceTags {
+		if tagString, ok := tag.(string); ok {
+			existing[tagString] = true
+		}
+	}
+
+	for _, tag := range tags {
+		if !existing[tag] {
+			instanceTags = append(instanceTags, tag)
+			existing[tag] = true
+		}
+	}
+	instanceMap["tags"] = instanceTags
+	return instanceMap, nil
+}
+
+// addTagsToEach will add tags to each of configs (a list of instances or logs configs).  Any we can't add tags to are
+// left as they are and logged
+func addTagsToEach(configs []interface{}, tags []string, monitor *services.Monitor) {
+	// log errors to stderr
+	logger := log.New(os.Stderr, log.Prefix(), 0)
+	for index, config := range configs {
+		tagged, err := addInstanceTags(config, tags)
+		if err != nil {
+			logger.Printf("Warning: Could not add tags to a config for service %s (%s): %v. Leaving its tags as they are.\n", monitor.Service.ID, monitor.ConfigTemplate, err)
+		}
+		configs[index] = tagged
+	}
+}
+
+// serviceInstanceTags returns the tags that tell datadog where an instance came from in consul.  Along with the
+// standard tags, any of the service's consul tags that match tagPatterns are included as they are, and any of its
+// metadata keys that match metaPatterns are included as <key>:<value>
+func serviceInstanceTags(service *services.Service, tagPatterns []*regexp.Regexp, metaPatterns []*regexp.Regexp) []string {
+	tags := []string{
+		fmt.Sprintf("consul_service:%s", service.Service),
+		fmt.Sprintf("consul_node:%s", service.Node),
+		fmt.Sprintf("consul_service_id:%s", service.ID),
+	}
+	if service.NodeInfo.Datacenter != "" {
+		tags = append(tags, fmt.Sprintf("datacenter:%s", service.NodeInfo.Datacenter))
+	}
+
+	for _, tag := range service.Tags {
+		if matchesAny(tag, tagPatterns) {
+			tags = append(tags, tag)
+		}
+	}
+
+	// metadata is a map so we sort it to keep our tags in a consistent order
+	metaKeys := make([]string, 0, len(service.Meta))
+	for key := range service.Meta {
+		if matchesAny(key, metaPatterns) {
+			metaKeys = append(metaKeys, key)
+		}
+	}
+	sort.Strings(metaKeys)
+	for _, key := range metaKeys {
+		tags = append(tags, fmt.Sprintf("%s:%s", key, service.Meta[key]))
+	}
+	return tags
+}
+
+// CompilePatterns turns a list of regular expressions into something we can match with
+func CompilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		expression, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+		}
+		compiled = append(compiled, expression)
+	}
+	return compiled, nil
+}
+
+// matchesAny checks if value matches any of patterns
+func matchesAny(value string, patterns []*regexp.Regexp) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
 }
@@ -2,186 +2,264 @@ package datadog
 
 import (
 	"bytes"
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 	"text/template"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/dansteen/consuldog/services"
 	consul "github.com/hashicorp/consul/api"
-	getter "github.com/hashicorp/go-getter"
 	"github.com/spf13/viper"
 )
 
 // WriteConfig will write out monitoring files for datadog based on the information provided in the services we have stored
-// It will always write all config files it knows about
-func WriteConfig(allServices services.Services) {
+// Files whose content has not changed are left alone, and any files it wrote in the past that no longer have any
+// monitors are removed.  Templates read from the consul KV store through keys.  It returns the paths of all the files
+// that were written or removed and the KV paths the templates read, along with an error if any monitor or file could
+// not be generated
+func WriteConfig(allServices services.Services, keys KeyReader) ([]string, KeyDependencies, error) {
 	// log errors to stderr
 	logger := log.New(os.Stderr, log.Prefix(), 0)
-	// a place to store all of our config Objects once they are populated
-	configObjects := make(map[string]CheckConf)
+	// a place to store all of our config Objects once they are populated, keyed on the file they will be written to
+	configObjects := make(map[string]*CheckConf)
+	// the files that had at least one monitor we could not generate
+	failed := make(map[string]bool)
+	// where each init_config setting in each file came from, so that we can report conflicts between them
+	initConfigSources := make(map[string]map[string]string)
+	// the files whose init_config settings conflict, which we refuse to write in strict mode
+	conflicted := make(map[string]bool)
+	strictInitConfig := viper.GetBool("strictInitConfig")
+	// the config files we want to keep this time around.  Any other file we generated in the past is stale
+	current := make(map[string]bool)
+	// the config files we actually changed
+	changed := make([]string, 0)
+	// the number of things that went wrong along the way
+	problems := 0
 	// get the templates we will need
 	templates := getConfTemplates(allServices)
+	// every template shares a KV lookup so we know everything they read
+	lookup := NewKeyLookup(keys)
+	// see how we should treat services that consul says are unhealthy
+	healthMode := viper.GetString("healthMode")
+	healthThreshold := viper.GetString("healthThreshold")
+	// and whether we should tag our instances with where they came from.  Our patterns were checked when we started up
+	addTags := viper.GetBool("instanceTags")
+	tagPatterns, _ := CompilePatterns(viper.GetStringSlice("instanceTagPatterns"))
+	metaPatterns, _ := CompilePatterns(viper.GetStringSlice("instanceMetaPatterns"))
 
 	// run through our services by type and generate datdog config files
-	for datadogType, monitors := range allServices.MonitorByType {
-		// create our aggregate config for this type
-		typeConfig := CheckConf{
-			InitConfig: make(map[string]interface{}),
-			Instances:  make([]interface{}, 0),
-		}
-
-		// run through each service of this type
-		for _, monitor := range monitors {
-			tmpBuf := new(bytes.Buffer)
-			// and instantiate our template if it exists
-			if ourTemplate, found := templates[monitor.ConfigTemplate]; found {
-				err := ourTemplate.Execute(tmpBuf, monitor.Service)
-				if err != nil {
-					logger.Println(err)
-					logger.Printf("Could not execute template %s for service %s. Skipping.\n", monitor.ConfigTemplate, monitor.Service.Service)
-					continue
+	for _, monitors := range allServices.MonitorByType {
+		// run through each service of this type.  We go through them in order so that, when their init_config settings
+		// disagree, the same service always wins
+		for _, monitor := range sortedMonitors(monitors) {
+			// work out which file this monitor ends up in, and create the aggregate config for that file if this is
+			// the first monitor we have seen for it
+			ddFilePath := configFilePath(monitor)
+			fileConfig, found := configObjects[ddFilePath]
+			if !found {
+				fileConfig = &CheckConf{
+					InitConfig: make(map[string]interface{}),
+					Instances:  make([]interface{}, 0),
+					Logs:       make([]interface{}, 0),
 				}
-				// if we did not find the template move on
-			} else {
-				logger.Printf("Could not find template %s for service %s. Skipping.\n", monitor.ConfigTemplate, monitor.Service.Service)
+				configObjects[ddFilePath] = fileConfig
+				initConfigSources[ddFilePath] = make(map[string]string)
+			}
+
+			// leave out services that consul already knows are in trouble if we have been asked to
+			unhealthy := healthMode != services.HealthModeIgnore && monitor.Service.Unhealthy(healthThreshold)
+			if unhealthy && healthMode == services.HealthModeSkip {
+				logger.Printf("Service %s is %s. Skipping.\n", monitor.Service.ID, monitor.Service.Health)
 				continue
 			}
 
-			// once we have the template, unMarshal the yaml
-			var config CheckConf
-			err := yaml.Unmarshal(tmpBuf.Bytes(), &config)
+			// render our template if it exists
+			ourTemplate, found := templates[monitor.ConfigTemplate]
+			if !found {
+				logger.Printf("Could not find template %s for service %s. Skipping.\n", monitor.ConfigTemplate, monitor.Service.Service)
+				failed[ddFilePath] = true
+				problems++
+				continue
+			}
+			config, _, err := RenderMonitor(ourTemplate, monitor, lookup)
 			if err != nil {
 				logger.Println(err)
-				logger.Printf("Could not convert template %s to object for service %s. Skipping.\n", monitor.ConfigTemplate, monitor.Service.Service)
+				logger.Printf("Could not render template %s for service %s. Skipping.\n", monitor.ConfigTemplate, monitor.Service.Service)
+				failed[ddFilePath] = true
+				problems++
 				continue
 			}
 
-			// once we've gotten to this point things look good so we add this config into our final config
+			// mark the instances (and logs) of unhealthy services so they can be told apart in datadog
+			if unhealthy && healthMode == services.HealthModeTag {
+				healthTags := []string{fmt.Sprintf("consul_health:%s", monitor.Service.Health)}
+				addTagsToEach(config.Instances, healthTags, monitor)
+				addTagsToEach(config.Logs, healthTags, monitor)
+			}
+			if addTags {
+				serviceTags := serviceInstanceTags(monitor.Service, tagPatterns, metaPatterns)
+				addTagsToEach(config.Instances, serviceTags, monitor)
+				addTagsToEach(config.Logs, serviceTags, monitor)
+			}
+
+			// once we've gotten to this point things look good so we add this config into our final config.  The first
+			// service to set an init_config setting wins
+			source := fmt.Sprintf("service %s (%s)", monitor.Service.ID, monitor.ConfigTemplate)
 			for initConfName, initConfValue := range config.InitConfig {
-				typeConfig.InitConfig[initConfName] = initConfValue
+				existingValue, found := fileConfig.InitConfig[initConfName]
+				if !found {
+					fileConfig.InitConfig[initConfName] = initConfValue
+					initConfigSources[ddFilePath][initConfName] = source
+					continue
+				}
+				if !reflect.DeepEqual(existingValue, initConfValue) {
+					logger.Printf("init_config setting %s for %s is %v from %s, but %v from %s. Using %v.\n", initConfName, ddFilePath, existingValue, initConfigSources[ddFilePath][initConfName], initConfValue, source, existingValue)
+					conflicted[ddFilePath] = true
+				}
 			}
 			for _, instance := range config.Instances {
-				typeConfig.Instances = append(typeConfig.Instances, instance)
+				fileConfig.Instances = append(fileConfig.Instances, instance)
+			}
+			for _, logConfig := range config.Logs {
+				fileConfig.Logs = append(fileConfig.Logs, logConfig)
 			}
 		}
+	}
 
-		// once we are done, add this typeConfig to our list
-		configObjects[datadogType] = typeConfig
+	// after we are done generating all of our configs, we write them out to config files.  We go through them in order
+	// so that our logs and the list of files we changed are consistent too
+	ddFilePaths := make([]string, 0, len(configObjects))
+	for ddFilePath := range configObjects {
+		ddFilePaths = append(ddFilePaths, ddFilePath)
 	}
+	sort.Strings(ddFilePaths)
+	for _, ddFilePath := range ddFilePaths {
+		config := configObjects[ddFilePath]
+		// if nothing could be generated for this file because of errors we leave the existing file alone rather than
+		// removing monitoring that was working before.  If there is simply nothing left to monitor, the file is stale
+		if config.empty() {
+			if failed[ddFilePath] {
+				current[ddFilePath] = true
+			}
+			continue
+		}
+		// we never want to remove a file just because we had trouble writing it this time
+		current[ddFilePath] = true
 
-	// after we are done generating all of our configs, we write them out to config files
-	for datadogType, config := range configObjects {
+		// in strict mode we would rather keep the last good version of a file than guess which settings are right
+		if strictInitConfig && conflicted[ddFilePath] {
+			logger.Printf("Could not write file %s since its init_config settings conflict. Skipping.\n", ddFilePath)
+			problems++
+			continue
+		}
+
+		// yaml sorts the keys of our maps for us, so the same config always comes out the same way
 		fileBytes, err := yaml.Marshal(config)
 		if err != nil {
 			logger.Println(err)
-			logger.Printf("Could not convert %s config to yaml file. Skipping.\n", datadogType)
+			logger.Printf("Could not convert %s config to yaml file. Skipping.\n", ddFilePath)
+			problems++
+			continue
+		}
+		// mark the file as ours so we know we can clean it up later
+		fileBytes = append([]byte(generatedHeader), fileBytes...)
+
+		// if the file already has exactly this content there is nothing to do
+		existingBytes, err := ioutil.ReadFile(ddFilePath)
+		if err == nil && bytes.Equal(existingBytes, fileBytes) {
 			continue
 		}
-		// put our datadog check filename together
-		ddFilePath := path.Join(viper.GetString("datadogFolder"), "conf.d", fmt.Sprintf("%s.yaml", datadogType))
 
-		err = ioutil.WriteFile(ddFilePath, fileBytes, 0644)
+		// agent 6 style check folders may not exist yet
+		err = makeConfigFolder(ddFilePath)
+		if err != nil {
+			logger.Println(err)
+			logger.Printf("Could not create folder for %s. Skipping.\n", ddFilePath)
+			problems++
+			continue
+		}
+		err = writeConfigFile(ddFilePath, fileBytes)
 		if err != nil {
 			logger.Println(err)
 			logger.Printf("Could not write file %s. Skipping.\n", ddFilePath)
+			problems++
 			continue
 		}
+		log.Printf("Wrote config file %s\n", ddFilePath)
+		changed = append(changed, ddFilePath)
+	}
+
+	// finally, get rid of the files for checks that no longer have anything to monitor
+	removed, removeProblems := removeStaleConfigs(current)
+	changed = append(changed, removed...)
+	problems += removeProblems
+
+	if problems > 0 {
+		return changed, lookup.Dependencies(), fmt.Errorf("%d monitors or config files could not be generated", problems)
+	}
+	return changed, lookup.Dependencies(), nil
+}
+
+// sortedMonitors returns a copy of monitors ordered by the ID of their service, and then by their position in their
+// service.  The order we get services from consul in changes from run to run, so without this the instances in our
+// configs would be shuffled around every time we wrote them
+func sortedMonitors(monitors []*services.Monitor) []*services.Monitor {
+	sorted := make([]*services.Monitor, len(monitors))
+	copy(sorted, monitors)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Service.ID != sorted[j].Service.ID {
+			return sorted[i].Service.ID < sorted[j].Service.ID
+		}
+		// service IDs are only unique within a node
+		if sorted[i].Service.Node != sorted[j].Service.Node {
+			return sorted[i].Service.Node < sorted[j].Service.Node
+		}
+		return sorted[i].Index < sorted[j].Index
+	})
+	return sorted
+}
+
+// configFilePath returns the path to the datadog config file that monitor should be written to.  With the agent 5
+// layout every monitor of a type shares conf.d/<type>.yaml.  With the agent 6 layout each service gets its own file in
+// conf.d/<type>.d/ so that it can sit alongside any config files that are already there.  Service IDs are only unique
+// within a node, so the node is part of the file name
+func configFilePath(monitor *services.Monitor) string {
+	confFolder := path.Join(viper.GetString("datadogFolder"), "conf.d")
+	if viper.GetString("datadogLayout") == LayoutAgent6 {
+		fileName := fmt.Sprintf("consuldog-%s__%s.yaml", safeFileName(monitor.Service.Node), safeFileName(monitor.Service.ID))
+		return path.Join(confFolder, fmt.Sprintf("%s.d", monitor.DatadogType), fileName)
 	}
+	return path.Join(confFolder, fmt.Sprintf("%s.yaml", monitor.DatadogType))
 }
 
 // getConfigTemplates will generate a map of templates keyed on service.ConfigTemplate for all templates that are required by allServices
-// templates must be valid yaml in the correct datadogFormat or it will be skipped
+// templates must be valid yaml in the correct datadogFormat or it will be skipped.  We go by the same monitors we
+// render so that every one of them has its template
 func getConfTemplates(allServices services.Services) map[string]*template.Template {
 	templates := make(map[string]*template.Template)
+	// the templates we have already tried to load
+	loaded := make(map[string]bool)
 	// create our logger
 	logger := log.New(os.Stderr, log.Prefix(), 0)
-	// variables to populate below
-	//var templatePath string
-	//var dudService services.Service
-	for _, service := range allServices.Services {
-		// for each monitor in our service
-		for _, monitor := range service.Monitors {
-			// first generate a temp filename
-			b := make([]byte, 16)
-			_, err := rand.Read(b)
-			if err != nil {
-				fmt.Println(err)
-				logger.Printf("Warning: Could not get random string %s. Skipping.\n", monitor.ConfigTemplate)
-				continue
-			}
-			randomString := base64.StdEncoding.EncodeToString(b)
-			templatePath := path.Join(viper.GetString("tempFolder"), fmt.Sprintf("%s.%s", path.Base(monitor.ConfigTemplate), randomString))
-			// then download the template file from the url provided
-			err = getter.GetFile(templatePath, monitor.ConfigTemplate)
-			if err != nil {
-				logger.Println(err)
-				logger.Printf("Could not get template for %s. Skipping.\n", monitor.ConfigTemplate)
-				continue
-			}
-
-			// read in the raw template file
-			rawTemplate, err := ioutil.ReadFile(templatePath)
-			if err != nil {
-				logger.Println(err)
-				logger.Printf("Could not load template for %s. Skipping.\n", monitor.ConfigTemplate)
-				continue
-			}
-			// if we can at least read the file we remove it.
-			err = os.Remove(templatePath)
-			if err != nil {
-				logger.Println(err)
-				logger.Printf("Warning: Could not remove temp file %s.\n", templatePath)
-			}
-
-			// turn our raw template string into a template object
-			tmpl, err := template.New(monitor.ConfigTemplate).Parse(string(rawTemplate))
-			if err != nil {
-				logger.Println(err)
-				logger.Printf("Could not create template for %s. Skipping.\n", monitor.ConfigTemplate)
-				continue
-			}
-
-			// YAML doesn't like {{ at the start of a scalar.  Unfortunately, this is common in our templates.  Fortunately, in usage, we de-template prior to actually UnMarshaling the template so here, when testing it we dud out the values first as well.
-			dudService := services.Service{
-				AgentService: consul.AgentService{
-					Address:     "127.0.0.1",
-					CreateIndex: 123456789,
-					ModifyIndex: 123456789,
-					ID:          "test-service-ID",
-					Port:        9999,
-					Service:     "test-service",
-					Tags:        []string{"tag1", "tag2"},
-				},
-				Monitors: []services.Monitor{
-					{
-						ConfigTemplate: monitor.ConfigTemplate,
-						DatadogType:    monitor.DatadogType,
-					},
-				},
-				Node: "test-node",
-			}
-			// instantiate our dud
-			dudInstance := new(bytes.Buffer)
-			err = tmpl.Execute(dudInstance, dudService)
-			if err != nil {
-				logger.Println(err)
-				logger.Printf("Could not execute template %s. Skipping.\n", monitor.ConfigTemplate)
+	for _, monitors := range allServices.MonitorByType {
+		// for each monitor of this type
+		for _, monitor := range monitors {
+			// we only need to load each template once, whether or not it worked
+			if loaded[monitor.ConfigTemplate] {
 				continue
 			}
+			loaded[monitor.ConfigTemplate] = true
 
-			// once we have an instantiated template make sure its valid YAML and conforms to the structrue we need for datadog
-			var config CheckConf
-			err = yaml.Unmarshal(dudInstance.Bytes(), &config)
+			tmpl, err := LoadTemplate(monitor.ConfigTemplate, monitor.DatadogType)
 			if err != nil {
 				logger.Println(err)
-				logger.Printf("%s is not valid YAML (or does not conform to our required structure) for %s. Please ensure its formatted correctly.  Skipping.\n", templatePath, monitor.ConfigTemplate)
+				logger.Printf("Could not load template %s. Skipping.\n", monitor.ConfigTemplate)
 				continue
 			}
 
@@ -191,3 +269,133 @@ func getConfTemplates(allServices services.Services) map[string]*template.Templa
 	}
 	return templates
 }
+
+// LoadTemplate will get the template at uri and parse it.  Before handing it back it makes sure the template
+// produces a config datadog can use by rendering it for a dud service
+func LoadTemplate(uri string, datadogType string) (*template.Template, error) {
+	tmpl, err := ParseTemplate(uri)
+	if err != nil {
+		return nil, err
+	}
+	_, err = ValidateTemplate(tmpl, datadogType)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// ParseTemplate will get the template at uri and turn it into a template object
+func ParseTemplate(uri string) (*template.Template, error) {
+	// get the raw template from the url provided
+	rawTemplate, err := fetchTemplate(uri)
+	if err != nil {
+		return nil, err
+	}
+	// missing parameters should come out empty rather than as <no value>.  Functions have to be in place before we parse
+	return template.New(uri).Option("missingkey=zero").Funcs(templateFuncs()).Parse(string(rawTemplate))
+}
+
+// ValidateTemplate makes sure tmpl produces a config datadog can use by rendering it for a dud service.  The rendered
+// template is returned so that problems can be tracked down
+func ValidateTemplate(tmpl *template.Template, datadogType string) ([]byte, error) {
+	// YAML doesn't like {{ at the start of a scalar.  Unfortunately, this is common in our templates.  Fortunately, in usage, we de-template prior to actually UnMarshaling the template so here, when testing it we dud out the values first as well.
+	_, rendered, err := RenderMonitor(tmpl, dudMonitor(tmpl.Name(), datadogType), NewKeyLookup(nil))
+	return rendered, err
+}
+
+// RenderMonitor will execute tmpl for monitor and turn the result into a datadog config.  Any KV lookups in the template
+// go through keys.  The rendered template is returned as well (even when it is not valid YAML) so that problems can be
+// tracked down
+func RenderMonitor(tmpl *template.Template, monitor *services.Monitor, keys *KeyLookup) (CheckConf, []byte, error) {
+	var config CheckConf
+	rendered := new(bytes.Buffer)
+	// point the KV functions at our lookup without changing the template everyone else is using
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return config, rendered.Bytes(), err
+	}
+	err = tmpl.Funcs(keys.funcs()).Execute(rendered, templateData(monitor))
+	if err != nil {
+		return config, rendered.Bytes(), err
+	}
+
+	// once we have an instantiated template make sure its valid YAML and conforms to the structrue we need for datadog
+	err = yaml.Unmarshal(rendered.Bytes(), &config)
+	if err != nil {
+		return config, rendered.Bytes(), fmt.Errorf("%s is not valid YAML (or does not conform to our required structure): %v", monitor.ConfigTemplate, err)
+	}
+	return config, rendered.Bytes(), nil
+}
+
+// TemplateContext is the data our templates are executed against.  It has the same fields as a service so that
+// templates can use them directly (e.g. {{ .Address }}).  We can't simply embed the service, because then {{ .Service }}
+// would be the whole service rather than its name
+type TemplateContext struct {
+	consul.AgentService
+	Monitors []services.Monitor
+	Node     string
+	NodeInfo consul.Node
+	Health   string
+	// Params holds the parameters given in the monitor definition (e.g. {{ .Params.path }})
+	Params map[string]string
+	// the monitor being rendered
+	DatadogType    string
+	ConfigTemplate string
+	// the node the service is on
+	NodeAddress string
+	Datacenter  string
+	NodeMeta    map[string]string
+	// ServiceMeta holds the consul metadata of the service
+	ServiceMeta map[string]string
+}
+
+// templateData returns the data a template is executed against for monitor
+func templateData(monitor *services.Monitor) interface{} {
+	return TemplateContext{
+		AgentService:   monitor.Service.AgentService,
+		Monitors:       monitor.Service.Monitors,
+		Node:           monitor.Service.Node,
+		NodeInfo:       monitor.Service.NodeInfo,
+		Health:         monitor.Service.Health,
+		Params:         monitor.Params,
+		DatadogType:    monitor.DatadogType,
+		ConfigTemplate: monitor.ConfigTemplate,
+		NodeAddress:    monitor.Service.NodeInfo.Address,
+		Datacenter:     monitor.Service.NodeInfo.Datacenter,
+		NodeMeta:       monitor.Service.NodeInfo.Meta,
+		ServiceMeta:    monitor.Service.Meta,
+	}
+}
+
+// dudMonitor returns a monitor for a made up service that we can use to test templates
+func dudMonitor(uri string, datadogType string) *services.Monitor {
+	dudService := services.Service{
+		AgentService: consul.AgentService{
+			Address:     "127.0.0.1",
+			CreateIndex: 123456789,
+			ModifyIndex: 123456789,
+			ID:          "test-service-ID",
+			Port:        9999,
+			Service:     "test-service",
+			Tags:        []string{"tag1", "tag2"},
+			Meta:        map[string]string{},
+		},
+		Monitors: []services.Monitor{
+			{
+				ConfigTemplate: uri,
+				DatadogType:    datadogType,
+				Params:         map[string]string{},
+			},
+		},
+		Node: "test-node",
+		NodeInfo: consul.Node{
+			ID:         "test-node-ID",
+			Node:       "test-node",
+			Address:    "127.0.0.1",
+			Datacenter: "test-dc",
+			Meta:       map[string]string{},
+		},
+	}
+	dudService.Monitors[0].Service = &dudService
+	return &dudService.Monitors[0]
+}
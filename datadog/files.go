@@ -0,0 +1,267 @@
+package datadog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/spf13/viper"
+)
+
+// the layouts we know how to write datadog config files in
+const (
+	// LayoutAgent5 writes a single conf.d/<type>.yaml file per datadog check
+	LayoutAgent5 = "agent5"
+	// LayoutAgent6 writes a conf.d/<type>.d/consuldog-<service id>.yaml file per service
+	LayoutAgent6 = "agent6"
+)
+
+// generatedHeader is written at the top of every config file we generate.  It lets us tell our files apart from ones
+// that were written by hand so we only ever clean up after ourselves
+const generatedHeader = "# This file is generated by consuldog. Any changes made to it will be overwritten.\n"
+
+// generatedByUs returns true if the file at configPath starts with our header
+func generatedByUs(configPath string) bool {
+	configFile, err := os.Open(configPath)
+	if err != nil {
+		return false
+	}
+	defer configFile.Close()
+
+	header := make([]byte, len(generatedHeader))
+	_, err = io.ReadFull(configFile, header)
+	return err == nil && string(header) == generatedHeader
+}
+
+// safeFileName replaces anything in name that we would not want to see in a file name with an underscore followed by
+// its hex code (e.g. web:80 becomes web_3a80).  Underscores are replaced as well, so two different names never end up
+// with the same file name, and a double underscore never shows up in the result
+func safeFileName(name string) string {
+	safe := new(bytes.Buffer)
+	for _, char := range []byte(name) {
+		if safeFileChars.Match([]byte{char}) {
+			safe.WriteByte(char)
+		} else {
+			fmt.Fprintf(safe, "_%02x", char)
+		}
+	}
+	return safe.String()
+}
+
+var safeFileChars = regexp.MustCompile(`^[A-Za-z0-9.-]$`)
+
+// ownedConfigFiles returns the paths of all the config files in the datadog conf.d folder that we generated.  We look
+// in both layouts so nothing is left behind when the layout is changed
+func ownedConfigFiles() []string {
+	owned := make([]string, 0)
+	confFolder := path.Join(viper.GetString("datadogFolder"), "conf.d")
+	paths, _ := filepath.Glob(path.Join(confFolder, "*.yaml"))
+	checkPaths, _ := filepath.Glob(path.Join(confFolder, "*.d", "*.yaml"))
+	paths = append(paths, checkPaths...)
+	for _, configPath := range paths {
+		if generatedByUs(configPath) {
+			owned = append(owned, configPath)
+		}
+	}
+	return owned
+}
+
+// removeStaleConfigs will remove every config file we generated in the past that is not in current.  Files that we
+// did not generate are never touched.  It returns the paths of the files it removed, and the number it could not
+func removeStaleConfigs(current map[string]bool) ([]string, int) {
+	// log errors to stderr
+	logger := log.New(os.Stderr, log.Prefix(), 0)
+	removed := make([]string, 0)
+	problems := 0
+	for _, configPath := range ownedConfigFiles() {
+		if current[configPath] {
+			continue
+		}
+		err := os.Remove(configPath)
+		if err != nil {
+			logger.Println(err)
+			logger.Printf("Could not remove stale config file %s. Skipping.\n", configPath)
+			problems++
+			continue
+		}
+		log.Printf("Removed stale config file %s\n", configPath)
+		removed = append(removed, configPath)
+	}
+	return removed, problems
+}
+
+// writeConfigFile will replace the config file at configPath with content without datadog ever being able to see a
+// partially written file.  Once written the file is read back and checked, and if it does not hold a usable config
+// the previous version of the file is put back
+func writeConfigFile(configPath string, content []byte) error {
+	// hang on to the last known good version so we can put it back if we need to
+	previous, previousErr := ioutil.ReadFile(configPath)
+	perm, group := configFileOwnership(configPath)
+
+	err := writeFileAtomic(configPath, content, perm, group)
+	if err != nil {
+		return err
+	}
+
+	// make sure what ended up on disk is what we meant to write
+	err = validateConfigFile(configPath, content)
+	if err == nil {
+		return nil
+	}
+	if previousErr == nil {
+		restoreErr := writeFileAtomic(configPath, previous, perm, group)
+		if restoreErr != nil {
+			return fmt.Errorf("%s failed validation (%v) and could not be restored: %v", configPath, err, restoreErr)
+		}
+		return fmt.Errorf("%s failed validation (%v) and was restored to its previous version", configPath, err)
+	}
+	// if there was no previous version, no file is better than a broken one
+	os.Remove(configPath)
+	return fmt.Errorf("%s failed validation (%v) and was removed", configPath, err)
+}
+
+// configFileOwnership works out the permissions and group a config file should be written with.  Templates can put
+// credentials from the KV store or our environment into configs, so by default they are not readable by everyone.  A
+// file we are replacing keeps its permissions and group, and a new file gets our configFileMode and the group of its
+// folder (which makeConfigFolder makes sure is the datadog agent's group)
+func configFileOwnership(configPath string) (os.FileMode, int) {
+	if info, err := os.Stat(configPath); err == nil {
+		return info.Mode().Perm(), fileGroup(info)
+	}
+	if info, err := os.Stat(path.Dir(configPath)); err == nil {
+		return ConfigFileMode(), fileGroup(info)
+	}
+	return ConfigFileMode(), -1
+}
+
+// ConfigFileMode returns the permissions new config files are written with, from our configFileMode setting (which
+// is in octal)
+func ConfigFileMode() os.FileMode {
+	mode, err := strconv.ParseUint(viper.GetString("configFileMode"), 8, 32)
+	if err != nil || mode > 0777 {
+		return 0640
+	}
+	return os.FileMode(mode)
+}
+
+// makeConfigFolder creates the folder configPath goes in (such as an agent 6 conf.d/<type>.d folder) if it does not
+// exist yet.  New folders are given to the group of conf.d (or of the datadog folder itself), so that the config
+// files we put in them can be read by the datadog agent even if we don't run as the same user it does
+func makeConfigFolder(configPath string) error {
+	folder := path.Dir(configPath)
+	if _, err := os.Stat(folder); err == nil {
+		return nil
+	}
+
+	// work out which group the agent uses, and which folders we are about to create, before we create them
+	group := -1
+	created := make([]string, 0)
+	for parent := folder; parent != "/" && parent != "."; parent = path.Dir(parent) {
+		info, err := os.Stat(parent)
+		if err == nil {
+			group = fileGroup(info)
+			break
+		}
+		created = append(created, parent)
+	}
+
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return err
+	}
+	// we can only give folders to groups we are in (unless we are root), in which case they keep our group
+	if group != -1 {
+		for _, createdFolder := range created {
+			os.Chown(createdFolder, -1, group)
+		}
+	}
+	return nil
+}
+
+// fileGroup returns the id of the group that owns the file described by info, or -1 if we can't tell
+func fileGroup(info os.FileInfo) int {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Gid)
+	}
+	return -1
+}
+
+// writeFileAtomic writes content to a temp file in the same folder as filePath, syncs it to disk, and then renames it
+// over the top of filePath.  Since the rename is atomic, anyone reading filePath sees either the old or the new
+// content and never anything in between.  The file is given to group unless it is -1
+func writeFileAtomic(filePath string, content []byte, perm os.FileMode, group int) error {
+	tempFile, err := ioutil.TempFile(path.Dir(filePath), fmt.Sprintf(".%s.", path.Base(filePath)))
+	if err != nil {
+		return err
+	}
+	// this only does anything if we fail before the rename
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(content)
+	if err != nil {
+		tempFile.Close()
+		return err
+	}
+	err = tempFile.Sync()
+	if err != nil {
+		tempFile.Close()
+		return err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+	// we can only give files to groups we are in (unless we are root), in which case the file keeps our group
+	if group != -1 {
+		os.Chown(tempFile.Name(), -1, group)
+	}
+	err = os.Chmod(tempFile.Name(), perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempFile.Name(), filePath)
+	if err != nil {
+		return err
+	}
+
+	// sync the folder as well so the rename itself survives a crash.  Not every filesystem supports this so we don't
+	// treat it as an error
+	if folder, err := os.Open(path.Dir(filePath)); err == nil {
+		folder.Sync()
+		folder.Close()
+	}
+	return nil
+}
+
+// validateConfigFile reads the config file at configPath back in and makes sure it matches what we wrote, and that
+// datadog will be able to use it
+func validateConfigFile(configPath string, expected []byte) error {
+	written, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(written, expected) {
+		return errors.New("file content does not match what was written")
+	}
+
+	var config CheckConf
+	err = yaml.Unmarshal(written, &config)
+	if err != nil {
+		return err
+	}
+	if config.empty() {
+		return errors.New("file does not contain any instances or logs")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package datadog
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestConfigFileMode(t *testing.T) {
+	tests := map[string]os.FileMode{
+		"0640":  0640,
+		"644":   0644,
+		"0600":  0600,
+		"":      0640,
+		"rw-r":  0640,
+		"01777": 0640,
+	}
+	for setting, expected := range tests {
+		restore := useSettings(map[string]interface{}{"configFileMode": setting})
+		if mode := ConfigFileMode(); mode != expected {
+			t.Errorf("expected %q to give %o, got %o", setting, expected, mode)
+		}
+		restore()
+	}
+}
+
+func TestNewConfigsGetTheAgentsGroup(t *testing.T) {
+	folder, err := ioutil.TempDir("", "consuldog-datadog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	confFolder := path.Join(folder, "conf.d")
+	if err := os.Mkdir(confFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// give conf.d a group other than our own if we can, like the datadog agent's group would be
+	if os.Getuid() == 0 {
+		os.Chown(confFolder, -1, 4242)
+	} else if groups, err := os.Getgroups(); err == nil {
+		for _, group := range groups {
+			if group != os.Getgid() {
+				os.Chown(confFolder, -1, group)
+				break
+			}
+		}
+	}
+	info, err := os.Stat(confFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentGroup := fileGroup(info)
+
+	restore := useSettings(map[string]interface{}{"datadogFolder": folder, "configFileMode": "0640"})
+	defer restore()
+	configPath := path.Join(confFolder, "apache.d", "consuldog-node1__web.yaml")
+	if err := makeConfigFolder(configPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeConfigFile(configPath, []byte("init_config:\ninstances:\n- apache_status_url: http://10.0.0.1/server-status?auto\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, created := range []string{path.Dir(configPath), configPath} {
+		info, err := os.Stat(created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group := fileGroup(info); group != agentGroup {
+			t.Errorf("expected %s to have group %d, got %d", created, agentGroup, group)
+		}
+	}
+	info, err = os.Stat(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("expected a new config to have mode 0640, got %o", info.Mode().Perm())
+	}
+}
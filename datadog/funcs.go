@@ -0,0 +1,230 @@
+package datadog
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/spf13/viper"
+)
+
+// templateFuncs returns the functions that are available to every template.  Where it makes sense, the value being
+// worked on is the last argument so that functions can be chained in a pipeline (e.g. {{ .Service | lower }})
+func templateFuncs() template.FuncMap {
+	funcs := template.FuncMap{
+		// strings
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"title":      strings.Title,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix string, value string) string { return strings.TrimPrefix(value, prefix) },
+		"trimSuffix": func(suffix string, value string) string { return strings.TrimSuffix(value, suffix) },
+		"replace":    func(old string, new string, value string) string { return strings.Replace(value, old, new, -1) },
+		"contains":   func(substring string, value string) bool { return strings.Contains(value, substring) },
+		"hasPrefix":  func(prefix string, value string) bool { return strings.HasPrefix(value, prefix) },
+		"hasSuffix":  func(suffix string, value string) bool { return strings.HasSuffix(value, suffix) },
+		"quote":      func(value interface{}) string { return fmt.Sprintf("%q", fmt.Sprint(value)) },
+		"indent":     indent,
+		// lists
+		"list":      func(items ...interface{}) []interface{} { return items },
+		"split":     func(separator string, value string) []string { return strings.Split(value, separator) },
+		"join":      join,
+		"first":     first,
+		"last":      last,
+		"has":       has,
+		"sortAlpha": sortAlpha,
+		// defaults
+		"default":  defaultValue,
+		"empty":    empty,
+		"coalesce": coalesce,
+		// regular expressions
+		"regexMatch":      regexMatch,
+		"regexFind":       regexFind,
+		"regexReplaceAll": regexReplaceAll,
+		// consuldog
+		"tagValue": tagValue,
+		"hasTag":   hasTag,
+		"toYaml":   toYaml,
+		"env":      env,
+	}
+	// the KV functions need to know where to read from, so these are replaced when the template is rendered
+	for name, function := range NewKeyLookup(nil).funcs() {
+		funcs[name] = function
+	}
+	return funcs
+}
+
+// indent puts spaces spaces in front of every line of value
+func indent(spaces int, value string) string {
+	padding := strings.Repeat(" ", spaces)
+	return padding + strings.Replace(value, "\n", "\n"+padding, -1)
+}
+
+// listItems turns any kind of slice or array into a list of its items.  Anything else is treated as an empty list
+func listItems(list interface{}) []interface{} {
+	items := make([]interface{}, 0)
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return items
+	}
+	for index := 0; index < value.Len(); index++ {
+		items = append(items, value.Index(index).Interface())
+	}
+	return items
+}
+
+// join joins the items in list together with separator between them
+func join(separator string, list interface{}) string {
+	parts := make([]string, 0)
+	for _, item := range listItems(list) {
+		parts = append(parts, fmt.Sprint(item))
+	}
+	return strings.Join(parts, separator)
+}
+
+// first returns the first item in list, or nothing if it is empty
+func first(list interface{}) interface{} {
+	items := listItems(list)
+	if len(items) == 0 {
+		return nil
+	}
+	return items[0]
+}
+
+// last returns the last item in list, or nothing if it is empty
+func last(list interface{}) interface{} {
+	items := listItems(list)
+	if len(items) == 0 {
+		return nil
+	}
+	return items[len(items)-1]
+}
+
+// has checks if needle is one of the items in list
+func has(needle interface{}, list interface{}) bool {
+	for _, item := range listItems(list) {
+		if reflect.DeepEqual(item, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortAlpha returns the items in list as strings in alphabetical order
+func sortAlpha(list interface{}) []string {
+	sorted := make([]string, 0)
+	for _, item := range listItems(list) {
+		sorted = append(sorted, fmt.Sprint(item))
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// defaultValue returns value unless it is empty, in which case it returns fallback
+func defaultValue(fallback interface{}, value interface{}) interface{} {
+	if empty(value) {
+		return fallback
+	}
+	return value
+}
+
+// empty checks if value is missing or the zero value of its type.  Empty lists and maps are empty as well
+func empty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
+		return reflected.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return reflected.IsNil()
+	}
+	return reflect.DeepEqual(value, reflect.Zero(reflected.Type()).Interface())
+}
+
+// coalesce returns the first of values that is not empty
+func coalesce(values ...interface{}) interface{} {
+	for _, value := range values {
+		if !empty(value) {
+			return value
+		}
+	}
+	return nil
+}
+
+// regexMatch checks if value matches the regular expression expression
+func regexMatch(expression string, value string) (bool, error) {
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		return false, err
+	}
+	return compiled.MatchString(value), nil
+}
+
+// regexFind returns the first part of value that matches the regular expression expression
+func regexFind(expression string, value string) (string, error) {
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		return "", err
+	}
+	return compiled.FindString(value), nil
+}
+
+// regexReplaceAll replaces every part of value that matches the regular expression expression with replacement.
+// replacement can refer to groups in the expression (e.g. $1)
+func regexReplaceAll(expression string, value string, replacement string) (string, error) {
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		return "", err
+	}
+	return compiled.ReplaceAllString(value, replacement), nil
+}
+
+// tagValue returns whatever follows prefix in the first of tags that starts with it (e.g. {{ .Tags | tagValue "env=" }}
+// gives "prod" for a service tagged "env=prod").  Nothing is returned if none of the tags start with prefix
+func tagValue(prefix string, tags []string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
+
+// hasTag checks if tag is one of tags
+func hasTag(tag string, tags []string) bool {
+	for _, existing := range tags {
+		if existing == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// env returns the value of the environment variable name.  Anyone who can register a service can choose a template,
+// so templates only get to see the variables that start with our templateEnvPrefix.  The rest of our environment
+// (such as CONSUL_HTTP_TOKEN) stays out of reach
+func env(name string) (string, error) {
+	envPrefix := viper.GetString("templateEnvPrefix")
+	if envPrefix == "" || !strings.HasPrefix(name, envPrefix) {
+		return "", fmt.Errorf("templates may only read environment variables that start with the templateEnvPrefix '%s', not %s", envPrefix, name)
+	}
+	return os.Getenv(name), nil
+}
+
+// toYaml turns value into yaml so that whole structures can be dropped into a template.  The trailing newline is
+// removed so that it can be used with indent
+func toYaml(value interface{}) (string, error) {
+	yamlBytes, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(yamlBytes), "\n"), nil
+}
@@ -0,0 +1,48 @@
+package datadog
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEnv(t *testing.T) {
+	os.Setenv("CONSULDOG_TEMPLATE_REGION", "us-east-1")
+	os.Setenv("CONSUL_HTTP_TOKEN", "secret")
+	defer os.Unsetenv("CONSULDOG_TEMPLATE_REGION")
+	defer os.Unsetenv("CONSUL_HTTP_TOKEN")
+
+	tests := []struct {
+		name      string
+		envPrefix string
+		variable  string
+		expected  string
+		allowed   bool
+	}{
+		{name: "variable with our prefix", envPrefix: "CONSULDOG_TEMPLATE_", variable: "CONSULDOG_TEMPLATE_REGION", expected: "us-east-1", allowed: true},
+		{name: "unset variable with our prefix", envPrefix: "CONSULDOG_TEMPLATE_", variable: "CONSULDOG_TEMPLATE_MISSING", expected: "", allowed: true},
+		{name: "variable without our prefix", envPrefix: "CONSULDOG_TEMPLATE_", variable: "CONSUL_HTTP_TOKEN", allowed: false},
+		{name: "prefix on its own is not enough", envPrefix: "CONSULDOG_TEMPLATE_", variable: "CONSULDOG_TEMPLATE", allowed: false},
+		{name: "no prefix allows nothing", envPrefix: "", variable: "CONSUL_HTTP_TOKEN", allowed: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			restore := useSettings(map[string]interface{}{"templateEnvPrefix": test.envPrefix})
+			defer restore()
+
+			value, err := env(test.variable)
+			if !test.allowed {
+				if err == nil || value != "" {
+					t.Fatalf("expected %s to be refused, got %q", test.variable, value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if value != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, value)
+			}
+		})
+	}
+}
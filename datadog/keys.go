@@ -0,0 +1,175 @@
+package datadog
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// KeyReader is what templates use to read values from the consul KV store
+type KeyReader interface {
+	// Key returns the value stored at path, and whether there was anything there at all
+	Key(path string) (string, bool, error)
+	// Tree returns every key under prefix (relative to prefix) along with its value
+	Tree(prefix string) (map[string]string, error)
+}
+
+// KeyDependencies holds the consul KV paths our templates read, so that they can be watched for changes
+type KeyDependencies struct {
+	Keys     []string
+	Prefixes []string
+}
+
+// KeyLookup reads values from the consul KV store for our templates, and keeps track of every path that was read.  Each
+// path is only read once, so every template sees the same value.  A KeyLookup without a reader hands back test values,
+// which is what we use when we validate templates
+type KeyLookup struct {
+	reader   KeyReader
+	keys     map[string]keyValue
+	prefixes map[string]map[string]string
+	// every path we were asked for, including the ones we could not read, so that they are watched all the same
+	wantedKeys     map[string]bool
+	wantedPrefixes map[string]bool
+}
+
+// keyValue is what we found at a single KV path
+type keyValue struct {
+	value  string
+	exists bool
+}
+
+// NewKeyLookup returns a KeyLookup that reads from reader.  reader can be nil to get test values instead
+func NewKeyLookup(reader KeyReader) *KeyLookup {
+	return &KeyLookup{
+		reader:         reader,
+		keys:           make(map[string]keyValue),
+		prefixes:       make(map[string]map[string]string),
+		wantedKeys:     make(map[string]bool),
+		wantedPrefixes: make(map[string]bool),
+	}
+}
+
+// Dependencies returns the paths that templates have asked for so far, in order.  Paths that could not be read are
+// included so that we notice when they can be
+func (lookup *KeyLookup) Dependencies() KeyDependencies {
+	dependencies := KeyDependencies{
+		Keys:     make([]string, 0),
+		Prefixes: make([]string, 0),
+	}
+	for path := range lookup.wantedKeys {
+		dependencies.Keys = append(dependencies.Keys, path)
+	}
+	for prefix := range lookup.wantedPrefixes {
+		dependencies.Prefixes = append(dependencies.Prefixes, prefix)
+	}
+	sort.Strings(dependencies.Keys)
+	sort.Strings(dependencies.Prefixes)
+	return dependencies
+}
+
+// funcs returns the template functions that read from the KV store through this lookup
+func (lookup *KeyLookup) funcs() template.FuncMap {
+	return template.FuncMap{
+		"key":          lookup.key,
+		"keyOrDefault": lookup.keyOrDefault,
+		"tree":         lookup.tree,
+	}
+}
+
+// allowed makes sure kvPath is under our kvPrefix.  Anyone who can register a service can get a template rendered, so
+// without this they could get at anything in the KV store our token can read.  Paths that consul (or anything between
+// us and it) might turn into a different path are never allowed, since they could take us outside of the prefix
+func allowed(kvPath string) error {
+	if strings.Contains(kvPath, "//") || strings.Contains(kvPath, "%") {
+		return fmt.Errorf("KV path %s may not contain '//' or '%%'", kvPath)
+	}
+	for _, segment := range strings.Split(kvPath, "/") {
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("KV path %s may not contain '.' or '..'", kvPath)
+		}
+	}
+
+	kvPrefix := viper.GetString("kvPrefix")
+	if kvPrefix == "" {
+		return nil
+	}
+	// we compare whole path segments so that a prefix of monitoring doesn't let templates into monitoring-secrets
+	cleanPath := strings.TrimPrefix(path.Clean("/"+kvPath), "/")
+	cleanPrefix := strings.TrimPrefix(path.Clean("/"+kvPrefix), "/")
+	if cleanPrefix == "" || cleanPath == cleanPrefix || strings.HasPrefix(cleanPath, cleanPrefix+"/") {
+		return nil
+	}
+	return fmt.Errorf("%s is outside of the KV prefix %s that templates are allowed to read", kvPath, kvPrefix)
+}
+
+// read gets the value at path, going to consul only the first time it is asked for
+func (lookup *KeyLookup) read(path string) (keyValue, error) {
+	err := allowed(path)
+	if err != nil {
+		return keyValue{}, err
+	}
+	lookup.wantedKeys[path] = true
+	if found, ok := lookup.keys[path]; ok {
+		return found, nil
+	}
+	found := keyValue{value: "test-value", exists: true}
+	if lookup.reader != nil {
+		value, exists, err := lookup.reader.Key(path)
+		if err != nil {
+			return found, err
+		}
+		found = keyValue{value: value, exists: exists}
+	}
+	lookup.keys[path] = found
+	return found, nil
+}
+
+// key returns the value at path.  It is an error for there to be nothing there, since the template would otherwise
+// produce a broken config.  We still watch the path so the config is generated once it shows up
+func (lookup *KeyLookup) key(path string) (string, error) {
+	found, err := lookup.read(path)
+	if err != nil {
+		return "", err
+	}
+	if !found.exists {
+		return "", fmt.Errorf("key %s does not exist in consul", path)
+	}
+	return found.value, nil
+}
+
+// keyOrDefault returns the value at path, or fallback if there is nothing there
+func (lookup *KeyLookup) keyOrDefault(path string, fallback string) (string, error) {
+	found, err := lookup.read(path)
+	if err != nil {
+		return "", err
+	}
+	if !found.exists || lookup.reader == nil {
+		return fallback, nil
+	}
+	return found.value, nil
+}
+
+// tree returns every key under prefix along with its value
+func (lookup *KeyLookup) tree(prefix string) (map[string]string, error) {
+	err := allowed(prefix)
+	if err != nil {
+		return nil, err
+	}
+	lookup.wantedPrefixes[prefix] = true
+	if found, ok := lookup.prefixes[prefix]; ok {
+		return found, nil
+	}
+	found := make(map[string]string)
+	if lookup.reader != nil {
+		found, err = lookup.reader.Tree(prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lookup.prefixes[prefix] = found
+	return found, nil
+}
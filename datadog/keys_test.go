@@ -0,0 +1,132 @@
+package datadog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dansteen/consuldog/communicator"
+	consul "github.com/hashicorp/consul/api"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		kvPrefix string
+		kvPath   string
+		allowed  bool
+	}{
+		{name: "no prefix", kvPrefix: "", kvPath: "secret/db", allowed: true},
+		{name: "no prefix still refuses parent folders", kvPrefix: "", kvPath: "monitoring/../secret/db", allowed: false},
+		{name: "inside the prefix", kvPrefix: "monitoring/", kvPath: "monitoring/mysql/password", allowed: true},
+		{name: "prefix without a trailing slash", kvPrefix: "monitoring", kvPath: "monitoring/mysql/password", allowed: true},
+		{name: "prefix with a leading slash", kvPrefix: "/monitoring/", kvPath: "monitoring/mysql/password", allowed: true},
+		{name: "path with a leading slash", kvPrefix: "monitoring/", kvPath: "/monitoring/mysql/password", allowed: true},
+		{name: "the prefix itself", kvPrefix: "monitoring/", kvPath: "monitoring", allowed: true},
+		{name: "the prefix itself as a folder", kvPrefix: "monitoring/", kvPath: "monitoring/", allowed: true},
+		{name: "outside the prefix", kvPrefix: "monitoring/", kvPath: "secret/db", allowed: false},
+		{name: "sibling that shares the prefix", kvPrefix: "monitoring", kvPath: "monitoring-secrets/db", allowed: false},
+		{name: "sibling that shares the prefix as a folder", kvPrefix: "monitoring/", kvPath: "monitoring-secrets/", allowed: false},
+		{name: "parent folder", kvPrefix: "monitoring/", kvPath: "monitoring/../secret/db", allowed: false},
+		{name: "parent folder at the end", kvPrefix: "monitoring/", kvPath: "monitoring/mysql/..", allowed: false},
+		{name: "parent folder at the start", kvPrefix: "monitoring/", kvPath: "../secret/db", allowed: false},
+		{name: "current folder", kvPrefix: "monitoring/", kvPath: "monitoring/./mysql", allowed: false},
+		{name: "double slash", kvPrefix: "monitoring/", kvPath: "monitoring//mysql", allowed: false},
+		{name: "escaped parent folder", kvPrefix: "monitoring/", kvPath: "monitoring/%2e%2e/secret/db", allowed: false},
+		{name: "escaped slash", kvPrefix: "monitoring/", kvPath: "monitoring/..%2fsecret", allowed: false},
+		{name: "dots inside a name", kvPrefix: "monitoring/", kvPath: "monitoring/my..sql/v1.2", allowed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			restore := useSettings(map[string]interface{}{"kvPrefix": test.kvPrefix})
+			defer restore()
+
+			err := allowed(test.kvPath)
+			if test.allowed && err != nil {
+				t.Errorf("expected %s to be allowed, got %v", test.kvPath, err)
+			}
+			if !test.allowed && err == nil {
+				t.Errorf("expected %s to be refused", test.kvPath)
+			}
+		})
+	}
+}
+
+// fakeKV is a consul KV endpoint that holds values, and records every path it is asked for
+type fakeKV struct {
+	sync.Mutex
+	values    map[string]string
+	requested []string
+}
+
+func (kv *fakeKV) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	kv.Lock()
+	defer kv.Unlock()
+	key := strings.TrimPrefix(request.URL.Path, "/v1/kv/")
+	kv.requested = append(kv.requested, key)
+
+	pairs := make(consul.KVPairs, 0)
+	for path, value := range kv.values {
+		_, recurse := request.URL.Query()["recurse"]
+		if path == key || (recurse && strings.HasPrefix(path, key)) {
+			pairs = append(pairs, &consul.KVPair{Key: path, Value: []byte(value)})
+		}
+	}
+	response.Header().Set("X-Consul-Index", "1")
+	if len(pairs) == 0 {
+		response.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(response).Encode(pairs)
+}
+
+func TestKeyLookupStaysInsideKVPrefix(t *testing.T) {
+	kv := &fakeKV{values: map[string]string{
+		"monitoring/mysql/user":  "datadog",
+		"monitoring/mysql/port":  "3306",
+		"secret/db":              "hunter2",
+		"monitoring-secrets/db":  "hunter3",
+		"monitoring/apache/path": "/server-status",
+	}}
+	// a ServeMux cleans up paths (and redirects to the result) just like consul does
+	mux := http.NewServeMux()
+	mux.Handle("/v1/kv/", kv)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	restore := useSettings(map[string]interface{}{"kvPrefix": "monitoring"})
+	defer restore()
+	client := communicator.NewConsulClient(communicator.ConsulConfig{Address: server.URL})
+	lookup := NewKeyLookup(&client)
+
+	for _, kvPath := range []string{"secret/db", "monitoring/../secret/db", "monitoring/%2e%2e/secret/db", "monitoring-secrets/db"} {
+		if value, err := lookup.key(kvPath); err == nil {
+			t.Errorf("expected reading %s to be refused, got %q", kvPath, value)
+		}
+		if tree, err := lookup.tree(kvPath); err == nil {
+			t.Errorf("expected reading everything under %s to be refused, got %v", kvPath, tree)
+		}
+	}
+	if len(kv.requested) != 0 {
+		t.Errorf("expected consul not to be asked for anything, but it was asked for %v", kv.requested)
+	}
+
+	value, err := lookup.key("monitoring/mysql/user")
+	if err != nil || value != "datadog" {
+		t.Errorf("expected datadog, got %q (%v)", value, err)
+	}
+	tree, err := lookup.tree("monitoring/mysql")
+	if err != nil || len(tree) != 2 || tree["port"] != "3306" {
+		t.Errorf("expected the two mysql keys, got %v (%v)", tree, err)
+	}
+
+	// paths we refused are not watched either
+	dependencies := lookup.Dependencies()
+	if strings.Join(dependencies.Keys, ",") != "monitoring/mysql/user" || strings.Join(dependencies.Prefixes, ",") != "monitoring/mysql" {
+		t.Errorf("unexpected dependencies %+v", dependencies)
+	}
+}
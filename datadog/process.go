@@ -3,10 +3,14 @@ package datadog
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/user"
-	"path/filepath"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
@@ -28,24 +32,33 @@ type Uid struct {
 type Status struct {
 	Name string
 	Pid  int
+	PPid int
 	Uid  Uid
 }
 
-//UnmarshalText will turn the status file into a usable structure for us
+// UnmarshalText will turn the status file into a usable structure for us
 func (status *Status) UnmarshalText(text []byte) error {
 	// scan our data and set our values
 	textBuf := bytes.NewBuffer(text)
 	scanner := bufio.NewScanner(textBuf)
 	for scanner.Scan() {
-		// the data is space delimited
+		// each line is a name and a value separated by a colon
 		line := strings.SplitN(scanner.Text(), ":", 2)
+		if len(line) != 2 {
+			continue
+		}
 		if line[0] == "Name" {
 			status.Name = strings.TrimSpace(line[1])
 		} else if line[0] == "Pid" {
 			status.Pid, _ = strconv.Atoi(strings.TrimSpace(line[1]))
+		} else if line[0] == "PPid" {
+			status.PPid, _ = strconv.Atoi(strings.TrimSpace(line[1]))
 		} else if line[0] == "Uid" {
 			// break up our line
-			uidLine := strings.SplitN(line[1], "\t", 4)
+			uidLine := strings.Fields(line[1])
+			if len(uidLine) != 4 {
+				return fmt.Errorf("malformed Uid line '%s'", scanner.Text())
+			}
 			real, _ := strconv.Atoi(uidLine[0])
 			eff, _ := strconv.Atoi(uidLine[1])
 			saved, _ := strconv.Atoi(uidLine[2])
@@ -63,18 +76,124 @@ func (status *Status) UnmarshalText(text []byte) error {
 	return scanner.Err()
 }
 
-// Reloader will reload the datadog process when a value is set on the reload channel
-func Reloader(reloadRequested <-chan bool, stop <-chan bool) {
-	// log errors to stderr
-	logger := log.New(os.Stderr, log.Prefix(), 0)
+// Process describes a process found by a ProcessFinder
+type Process struct {
+	Pid     int
+	Name    string
+	Cmdline string
+	Exe     string
+}
+
+// ProcessFinder finds processes by looking through proc.  A process has to match every filter that is set to be found
+type ProcessFinder struct {
+	// ProcRoot is the folder proc is mounted on (normally /proc)
+	ProcRoot string
+	// Name matches the name of the process.  Either the name in its status file (which the kernel cuts off at 15
+	// characters) or the file name of the first part of its command line can match
+	Name string
+	// Cmdline matches the full command line of the process, with its arguments separated by spaces
+	Cmdline *regexp.Regexp
+	// Exe matches the path of the executable the process is running
+	Exe *regexp.Regexp
+	// Cgroup matches any of the lines in the cgroup file of the process (e.g. 0::/system.slice/datadog-agent.service)
+	Cgroup *regexp.Regexp
+	// ParentPid matches the pid of the parent of the process.  Zero matches any parent
+	ParentPid int
+	// UID matches the effective uid of the process.  A negative UID matches any user
+	UID int
+}
+
+// Find returns every process that matches our filters.  Processes can come and go while we are looking, so any process
+// we can't read is skipped.  It is only an error if we can't look through ProcRoot at all
+func (finder ProcessFinder) Find() ([]Process, error) {
+	found := make([]Process, 0)
+	entries, err := ioutil.ReadDir(finder.ProcRoot)
+	if err != nil {
+		return found, err
+	}
+	for _, entry := range entries {
+		// only the numbered folders are processes
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		process, matched := finder.match(pid)
+		if matched {
+			found = append(found, process)
+		}
+	}
+	return found, nil
+}
+
+// match reads the details of process pid and checks them against our filters.  The cheapest checks are done first
+func (finder ProcessFinder) match(pid int) (Process, bool) {
+	process := Process{Pid: pid}
+	procFolder := path.Join(finder.ProcRoot, strconv.Itoa(pid))
+
+	// we start fresh for each process so nothing carries over from the last one
+	statusData, err := ioutil.ReadFile(path.Join(procFolder, "status"))
+	if err != nil {
+		return process, false
+	}
+	status := Status{}
+	if status.UnmarshalText(statusData) != nil {
+		return process, false
+	}
+	process.Name = status.Name
+	if finder.UID >= 0 && status.Uid.Effective != finder.UID {
+		return process, false
+	}
+	if finder.ParentPid != 0 && status.PPid != finder.ParentPid {
+		return process, false
+	}
+
+	// the arguments in cmdline are separated (and ended) by nulls
+	cmdlineData, err := ioutil.ReadFile(path.Join(procFolder, "cmdline"))
+	if err != nil {
+		return process, false
+	}
+	arguments := strings.Split(strings.TrimRight(string(cmdlineData), "\x00"), "\x00")
+	process.Cmdline = strings.Join(arguments, " ")
+	if finder.Name != "" && status.Name != finder.Name && path.Base(arguments[0]) != finder.Name {
+		return process, false
+	}
+	if finder.Cmdline != nil && !finder.Cmdline.MatchString(process.Cmdline) {
+		return process, false
+	}
+
+	// we can only see where the executable of other users' processes is if we are allowed to
+	process.Exe, _ = os.Readlink(path.Join(procFolder, "exe"))
+	if finder.Exe != nil && (process.Exe == "" || !finder.Exe.MatchString(process.Exe)) {
+		return process, false
+	}
+
+	if finder.Cgroup != nil {
+		cgroupData, err := ioutil.ReadFile(path.Join(procFolder, "cgroup"))
+		if err != nil {
+			return process, false
+		}
+		matched := false
+		for _, line := range strings.Split(string(cgroupData), "\n") {
+			if finder.Cgroup.MatchString(line) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return process, false
+		}
+	}
+	return process, true
+}
+
+// Reloader will reload the datadog process when a value is set on the reload channel.  It keeps going until ctx is
+// cancelled, at which point it makes sure any reload that is still pending happens before it returns
+func Reloader(ctx context.Context, reloadRequested <-chan bool) {
 	// set up a ticker to trigger the actual reload
 	ticker := time.NewTicker(time.Duration(viper.GetInt64("datadogMinReloadInterval")) * time.Second)
+	defer ticker.Stop()
 	// store a value to see if we should actually reload or not
 	reload := false
-	// get the Effective UID of the current consuldog process
-	ourUID := os.Geteuid()
-	// get the name of the process we are looking for
-	datadogProcName := viper.GetString("datadogProcName")
 
 	// listen for requests
 	for {
@@ -82,57 +201,92 @@ func Reloader(reloadRequested <-chan bool, stop <-chan bool) {
 		case <-ticker.C:
 			// we only proceed if a reload has been requested
 			if reload == true {
-				// record if we have actually reloaded anything
-				reloaded := false
-				// place to store our /proc/*/status information
-				statusData := make([]byte, 2048)
-				status := Status{}
-				// run through all the processes
-				paths, _ := filepath.Glob("/proc/*/status")
-				for _, path := range paths {
-					// see if this one matches the name we are looking for and the user
-					// we ignore errors for all this since we expect that some proceses will disappear prior to us being done with them
-					// if the name of the process is greater than 512 bytes we don't bother to continue reading as it is unlikely
-					// that we have the file that we are looking for
-					commFile, _ := os.Open(path)
-					commFile.Read(statusData)
-					// convert the file to our struct
-					status.UnmarshalText(statusData)
-					// once we have our data we see if it matches
-					if status.Name == datadogProcName && status.Uid.Effective == ourUID {
-						// grab the process and send a signal
-						osProcess, _ := os.FindProcess(status.Pid)
-						err := osProcess.Signal(syscall.SIGHUP)
-						// if we succeeded we make a note of it, otherwise we print a message
-						if err != nil {
-							logger.Printf("Failed to send reload signal to %s (%v):\n", status.Name, status.Pid)
-							logger.Println(err)
-						} else {
-							log.Printf("Reloaded %s (%v)\n", status.Name, status.Pid)
-							reloaded = true
-						}
-					}
-				}
-
-				// if we haven't actually reloaded anything we post a message
-				if reloaded == false {
-					// convert our uid to a name if we can
-					var userName string
-					ourUser, err := user.LookupId(strconv.Itoa(ourUID))
-					if err != nil {
-						userName = "<unknown>"
-					} else {
-						userName = ourUser.Username
-					}
-					logger.Printf("Could not find or successfully signal any processes named '%s' owned  by %s(%d). Datadog Reload Skipped.\n", datadogProcName, userName, ourUID)
-					// reset our reload value
-				}
+				Reload(ctx)
 				reload = false
 			}
 		case <-reloadRequested:
 			reload = true
-		case <-stop:
+		case <-ctx.Done():
+			// pick up any request that came in at the same time we were told to stop
+			select {
+			case <-reloadRequested:
+				reload = true
+			default:
+			}
+			if reload == true {
+				Reload(ctx)
+			}
 			return
 		}
 	}
 }
+
+// SignalByName reloads datadog by sending a HUP signal to every process Finder finds
+type SignalByName struct {
+	Finder ProcessFinder
+}
+
+// Reload sends the signal.  It is only an error if no process could be reloaded
+func (strategy SignalByName) Reload() error {
+	// log errors to stderr
+	logger := log.New(os.Stderr, log.Prefix(), 0)
+	processes, err := strategy.Finder.Find()
+	if err != nil {
+		return err
+	}
+
+	// record if we have actually reloaded anything
+	reloaded := false
+	for _, process := range processes {
+		// grab the process and send a signal
+		osProcess, _ := os.FindProcess(process.Pid)
+		err := osProcess.Signal(syscall.SIGHUP)
+		// if we succeeded we make a note of it, otherwise we print a message
+		if err != nil {
+			logger.Printf("Failed to send reload signal to %s (%v):\n", process.Name, process.Pid)
+			logger.Println(err)
+		} else {
+			log.Printf("Reloaded %s (%v)\n", process.Name, process.Pid)
+			reloaded = true
+		}
+	}
+
+	// if we haven't actually reloaded anything we let our caller know
+	if reloaded == false {
+		return fmt.Errorf("could not find or successfully signal any %s", strategy.Finder)
+	}
+	return nil
+}
+
+func (strategy SignalByName) String() string {
+	return fmt.Sprintf("signaling %s", strategy.Finder)
+}
+
+// String describes the processes finder looks for
+func (finder ProcessFinder) String() string {
+	filters := make([]string, 0)
+	if finder.Name != "" {
+		filters = append(filters, fmt.Sprintf("named '%s'", finder.Name))
+	}
+	if finder.Cmdline != nil {
+		filters = append(filters, fmt.Sprintf("with a command line matching '%s'", finder.Cmdline))
+	}
+	if finder.Exe != nil {
+		filters = append(filters, fmt.Sprintf("running an executable matching '%s'", finder.Exe))
+	}
+	if finder.Cgroup != nil {
+		filters = append(filters, fmt.Sprintf("in a cgroup matching '%s'", finder.Cgroup))
+	}
+	if finder.ParentPid != 0 {
+		filters = append(filters, fmt.Sprintf("started by %d", finder.ParentPid))
+	}
+	if finder.UID >= 0 {
+		// convert our uid to a name if we can
+		userName := "<unknown>"
+		if owner, err := user.LookupId(strconv.Itoa(finder.UID)); err == nil {
+			userName = owner.Username
+		}
+		filters = append(filters, fmt.Sprintf("owned by %s(%d)", userName, finder.UID))
+	}
+	return fmt.Sprintf("processes %s", strings.Join(filters, " "))
+}
@@ -0,0 +1,404 @@
+package datadog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeProcess describes a process to put in a fake proc folder
+type fakeProcess struct {
+	pid     int
+	name    string
+	ppid    int
+	uid     int
+	cmdline []string
+	exe     string
+	cgroup  string
+}
+
+// fakeProcRoot builds a proc folder holding processes in a temporary folder, and returns its path
+func fakeProcRoot(t *testing.T, processes ...fakeProcess) string {
+	root, err := ioutil.TempDir("", "consuldog-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, process := range processes {
+		writeFakeProcess(t, root, process)
+	}
+	// proc has plenty of things in it that are not processes
+	writeFakeFile(t, path.Join(root, "uptime"), "12345.67 12345.67\n")
+	writeFakeFile(t, path.Join(root, "self", "status"), "Name:\tself\n")
+	return root
+}
+
+// writeFakeProcess adds process to the fake proc folder at root
+func writeFakeProcess(t *testing.T, root string, process fakeProcess) {
+	procFolder := path.Join(root, fmt.Sprint(process.pid))
+	status := fmt.Sprintf("Name:\t%s\nUmask:\t0022\nState:\tS (sleeping)\nPid:\t%d\nPPid:\t%d\nUid:\t%d\t%d\t%d\t%d\n",
+		process.name, process.pid, process.ppid, process.uid, process.uid, process.uid, process.uid)
+	writeFakeFile(t, path.Join(procFolder, "status"), status)
+	// the kernel ends every argument with a null, and kernel threads have no arguments at all
+	cmdline := ""
+	for _, argument := range process.cmdline {
+		cmdline += argument + "\x00"
+	}
+	writeFakeFile(t, path.Join(procFolder, "cmdline"), cmdline)
+	writeFakeFile(t, path.Join(procFolder, "cgroup"), process.cgroup)
+	if process.exe != "" {
+		err := os.Symlink(process.exe, path.Join(procFolder, "exe"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeFakeFile(t *testing.T, filePath string, content string) {
+	err := os.MkdirAll(path.Dir(filePath), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filePath, []byte(content), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// foundPids returns the pids of the processes finder finds, in order
+func foundPids(t *testing.T, finder ProcessFinder) []int {
+	processes, err := finder.Find()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pids := make([]int, 0, len(processes))
+	for _, process := range processes {
+		pids = append(pids, process.Pid)
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// standardProcesses are the processes most of our tests look through
+var standardProcesses = []fakeProcess{
+	// the agent 6 agent, along with a couple of the processes it starts
+	{
+		pid:     100,
+		name:    "agent",
+		ppid:    1,
+		uid:     998,
+		cmdline: []string{"/opt/datadog-agent/bin/agent/agent", "run", "-p", "/opt/datadog-agent/run/agent.pid"},
+		exe:     "/opt/datadog-agent/bin/agent/agent",
+		cgroup:  "12:pids:/system.slice/datadog-agent.service\n0::/system.slice/datadog-agent.service\n",
+	},
+	{
+		pid:     101,
+		name:    "trace-agent",
+		ppid:    100,
+		uid:     998,
+		cmdline: []string{"/opt/datadog-agent/embedded/bin/trace-agent", "--config", "/etc/datadog-agent/datadog.yaml"},
+		exe:     "/opt/datadog-agent/embedded/bin/trace-agent",
+		cgroup:  "0::/system.slice/datadog-agent.service\n",
+	},
+	// the kernel cuts the name in the status file off at 15 characters
+	{
+		pid:     102,
+		name:    "datadog-supervi",
+		ppid:    1,
+		uid:     0,
+		cmdline: []string{"/opt/datadog-agent/bin/datadog-supervisord", "-c", "/etc/dd-agent/supervisor.conf"},
+		exe:     "/opt/datadog-agent/embedded/bin/python2.7",
+		cgroup:  "0::/system.slice/datadog-agent.service\n",
+	},
+	// an unrelated process with the same name, owned by someone else
+	{
+		pid:     200,
+		name:    "agent",
+		ppid:    1,
+		uid:     1000,
+		cmdline: []string{"./agent", "--debug"},
+		exe:     "/home/someone/agent",
+		cgroup:  "0::/user.slice/user-1000.slice/session-2.scope\n",
+	},
+	// a python script whose name is that of the interpreter, but whose first argument has been changed
+	{
+		pid:     201,
+		name:    "python2.7",
+		ppid:    1,
+		uid:     998,
+		cmdline: []string{"/opt/datadog-agent/bin/dogstatsd"},
+		exe:     "/usr/bin/python2.7",
+		cgroup:  "0::/system.slice/dogstatsd.service\n",
+	},
+	// kernel threads have an empty command line and no executable
+	{
+		pid:    2,
+		name:   "kthreadd",
+		ppid:   0,
+		uid:    0,
+		cgroup: "0::/\n",
+	},
+}
+
+func TestProcessFinderFilters(t *testing.T) {
+	root := fakeProcRoot(t, standardProcesses...)
+	defer os.RemoveAll(root)
+
+	tests := []struct {
+		name     string
+		finder   ProcessFinder
+		expected []int
+	}{
+		{
+			name:     "name",
+			finder:   ProcessFinder{Name: "agent", UID: -1},
+			expected: []int{100, 200},
+		},
+		{
+			name:     "name cut off at 15 characters",
+			finder:   ProcessFinder{Name: "datadog-supervi", UID: -1},
+			expected: []int{102},
+		},
+		{
+			name:     "full name from the command line",
+			finder:   ProcessFinder{Name: "datadog-supervisord", UID: -1},
+			expected: []int{102},
+		},
+		{
+			name:     "name from the first argument",
+			finder:   ProcessFinder{Name: "dogstatsd", UID: -1},
+			expected: []int{201},
+		},
+		{
+			name:     "name of a kernel thread",
+			finder:   ProcessFinder{Name: "kthreadd", UID: -1},
+			expected: []int{2},
+		},
+		{
+			name:     "name that is only part of a process name",
+			finder:   ProcessFinder{Name: "trace", UID: -1},
+			expected: []int{},
+		},
+		{
+			name:     "command line",
+			finder:   ProcessFinder{Cmdline: regexp.MustCompile(`^/opt/datadog-agent/bin/agent/agent run`), UID: -1},
+			expected: []int{100},
+		},
+		{
+			name:     "command line arguments",
+			finder:   ProcessFinder{Cmdline: regexp.MustCompile(`--config /etc/datadog-agent/`), UID: -1},
+			expected: []int{101},
+		},
+		{
+			name:     "command line of a kernel thread is empty",
+			finder:   ProcessFinder{Cmdline: regexp.MustCompile(`.`), UID: 0},
+			expected: []int{102},
+		},
+		{
+			name:     "executable",
+			finder:   ProcessFinder{Exe: regexp.MustCompile(`^/opt/datadog-agent/`), UID: -1},
+			expected: []int{100, 101, 102},
+		},
+		{
+			name:     "executable needs an exe link",
+			finder:   ProcessFinder{Exe: regexp.MustCompile(`.*`), UID: 0},
+			expected: []int{102},
+		},
+		{
+			name:     "cgroup",
+			finder:   ProcessFinder{Cgroup: regexp.MustCompile(`datadog-agent\.service$`), UID: -1},
+			expected: []int{100, 101, 102},
+		},
+		{
+			name:     "any cgroup line",
+			finder:   ProcessFinder{Cgroup: regexp.MustCompile(`^12:pids:`), UID: -1},
+			expected: []int{100},
+		},
+		{
+			name:     "parent",
+			finder:   ProcessFinder{ParentPid: 100, UID: -1},
+			expected: []int{101},
+		},
+		{
+			name:     "uid",
+			finder:   ProcessFinder{Name: "agent", UID: 998},
+			expected: []int{100},
+		},
+		{
+			name:     "root",
+			finder:   ProcessFinder{UID: 0},
+			expected: []int{2, 102},
+		},
+		{
+			name:     "any user",
+			finder:   ProcessFinder{UID: -1},
+			expected: []int{2, 100, 101, 102, 200, 201},
+		},
+		{
+			name: "every filter at once",
+			finder: ProcessFinder{
+				Name:      "trace-agent",
+				Cmdline:   regexp.MustCompile(`trace-agent`),
+				Exe:       regexp.MustCompile(`/embedded/bin/`),
+				Cgroup:    regexp.MustCompile(`datadog-agent`),
+				ParentPid: 100,
+				UID:       998,
+			},
+			expected: []int{101},
+		},
+		{
+			name: "every filter but one",
+			finder: ProcessFinder{
+				Name:      "trace-agent",
+				Cmdline:   regexp.MustCompile(`trace-agent`),
+				Exe:       regexp.MustCompile(`/embedded/bin/`),
+				Cgroup:    regexp.MustCompile(`datadog-agent`),
+				ParentPid: 1,
+				UID:       998,
+			},
+			expected: []int{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.finder.ProcRoot = root
+			pids := foundPids(t, test.finder)
+			if !reflect.DeepEqual(pids, test.expected) {
+				t.Errorf("%s: expected %v, got %v", test.finder, test.expected, pids)
+			}
+		})
+	}
+}
+
+func TestProcessFinderDetails(t *testing.T) {
+	root := fakeProcRoot(t, standardProcesses...)
+	defer os.RemoveAll(root)
+
+	processes, err := ProcessFinder{ProcRoot: root, Name: "trace-agent", UID: -1}.Find()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []Process{
+		{
+			Pid:     101,
+			Name:    "trace-agent",
+			Cmdline: "/opt/datadog-agent/embedded/bin/trace-agent --config /etc/datadog-agent/datadog.yaml",
+			Exe:     "/opt/datadog-agent/embedded/bin/trace-agent",
+		},
+	}
+	if !reflect.DeepEqual(processes, expected) {
+		t.Errorf("expected %+v, got %+v", expected, processes)
+	}
+}
+
+func TestProcessFinderVanishingProcesses(t *testing.T) {
+	root := fakeProcRoot(t, standardProcesses...)
+	defer os.RemoveAll(root)
+
+	// a process that went away before we could read anything about it
+	err := os.MkdirAll(path.Join(root, "300"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and one that went away between reading its status and its command line
+	writeFakeProcess(t, root, fakeProcess{pid: 301, name: "agent", ppid: 1, uid: 998, cmdline: []string{"agent"}})
+	err = os.Remove(path.Join(root, "301", "cmdline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// and one that went away before we got to its cgroup
+	writeFakeProcess(t, root, fakeProcess{pid: 302, name: "agent", ppid: 1, uid: 998, cmdline: []string{"agent"}})
+	err = os.Remove(path.Join(root, "302", "cgroup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pids := foundPids(t, ProcessFinder{ProcRoot: root, Name: "agent", UID: 998})
+	if !reflect.DeepEqual(pids, []int{100, 302}) {
+		t.Errorf("expected [100 302], got %v", pids)
+	}
+	pids = foundPids(t, ProcessFinder{ProcRoot: root, Name: "agent", Cgroup: regexp.MustCompile(`.`), UID: 998})
+	if !reflect.DeepEqual(pids, []int{100}) {
+		t.Errorf("expected [100], got %v", pids)
+	}
+}
+
+func TestProcessFinderMalformedStatus(t *testing.T) {
+	root := fakeProcRoot(t, standardProcesses...)
+	defer os.RemoveAll(root)
+
+	// a Uid line with the wrong number of fields is skipped rather than being treated as uid 0
+	writeFakeFile(t, path.Join(root, "400", "status"), "Name:\tagent\nPid:\t400\nPPid:\t1\nUid:\t0\t0\n")
+	writeFakeFile(t, path.Join(root, "400", "cmdline"), "agent\x00")
+
+	pids := foundPids(t, ProcessFinder{ProcRoot: root, Name: "agent", UID: -1})
+	if !reflect.DeepEqual(pids, []int{100, 200}) {
+		t.Errorf("expected [100 200], got %v", pids)
+	}
+}
+
+func TestProcessFinderMissingProcRoot(t *testing.T) {
+	_, err := ProcessFinder{ProcRoot: "/does/not/exist", Name: "agent", UID: -1}.Find()
+	if err == nil {
+		t.Error("expected an error for a missing proc folder")
+	}
+}
+
+func TestStatusUnmarshalText(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected Status
+		err      string
+	}{
+		{
+			name: "full status",
+			text: "Name:\tagent\nUmask:\t0022\nState:\tS (sleeping)\nTgid:\t100\nPid:\t100\nPPid:\t1\nUid:\t998\t999\t997\t996\nGid:\t998\t998\t998\t998\n",
+			expected: Status{
+				Name: "agent",
+				Pid:  100,
+				PPid: 1,
+				Uid:  Uid{Real: 998, Effective: 999, Saved: 997, Filesystem: 996},
+			},
+		},
+		{
+			name:     "name with spaces",
+			text:     "Name:\tkworker/0:1 events\nPid:\t5\n",
+			expected: Status{Name: "kworker/0:1 events", Pid: 5},
+		},
+		{
+			name:     "lines without a colon",
+			text:     "Name:\tagent\nnonsense\n\nPid:\t100\n",
+			expected: Status{Name: "agent", Pid: 100},
+		},
+		{
+			name: "malformed uid line",
+			text: "Name:\tagent\nPid:\t100\nUid:\t998\n",
+			err:  "malformed Uid line",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := Status{}
+			err := status.UnmarshalText([]byte(test.text))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(status, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, status)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package datadog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// the ways we know how to get datadog to pick up new configs
+const (
+	// ReloadSignal sends a HUP signal to the datadog processes our datadogProc settings describe
+	ReloadSignal = "signal"
+	// ReloadPidFile sends a HUP signal to the process whose pid is in our datadogPidFile
+	ReloadPidFile = "pidfile"
+	// ReloadCommand runs our reloadCommand
+	ReloadCommand = "command"
+	// ReloadHTTP makes a request to our reloadURL
+	ReloadHTTP = "http"
+)
+
+// ReloadStrategy is a way of getting datadog to pick up new configs
+type ReloadStrategy interface {
+	// Reload asks datadog to reload, and returns an error if that could not be done
+	Reload() error
+	// String describes the strategy for our logs
+	String() string
+}
+
+// NewReloadStrategy returns the reload strategy our settings ask for
+func NewReloadStrategy() (ReloadStrategy, error) {
+	timeout := time.Duration(viper.GetInt64("reloadTimeout")) * time.Second
+	switch viper.GetString("reloadStrategy") {
+	case ReloadSignal:
+		finder, err := processFinder()
+		if err != nil {
+			return nil, err
+		}
+		return SignalByName{
+			Finder: finder,
+		}, nil
+	case ReloadPidFile:
+		if viper.GetString("datadogPidFile") == "" {
+			return nil, fmt.Errorf("the %s reload strategy needs a datadogPidFile", ReloadPidFile)
+		}
+		return SignalByPidFile{
+			PidFile: viper.GetString("datadogPidFile"),
+		}, nil
+	case ReloadCommand:
+		if viper.GetString("reloadCommand") == "" {
+			return nil, fmt.Errorf("the %s reload strategy needs a reloadCommand", ReloadCommand)
+		}
+		return RunCommand{
+			Command: viper.GetString("reloadCommand"),
+			Timeout: timeout,
+		}, nil
+	case ReloadHTTP:
+		if viper.GetString("reloadURL") == "" {
+			return nil, fmt.Errorf("the %s reload strategy needs a reloadURL", ReloadHTTP)
+		}
+		return HTTPRequest{
+			URL:     viper.GetString("reloadURL"),
+			Method:  viper.GetString("reloadMethod"),
+			Timeout: timeout,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown reload strategy '%s'", viper.GetString("reloadStrategy"))
+}
+
+// processFinder returns a ProcessFinder for the datadog processes our settings describe
+func processFinder() (ProcessFinder, error) {
+	finder := ProcessFinder{
+		ProcRoot:  viper.GetString("procRoot"),
+		ParentPid: viper.GetInt("datadogProcParent"),
+		UID:       os.Geteuid(),
+	}
+	if viper.GetBool("datadogProcAnyUser") {
+		finder.UID = -1
+	}
+	patterns := map[string]**regexp.Regexp{
+		"datadogProcCmdline": &finder.Cmdline,
+		"datadogProcExe":     &finder.Exe,
+		"datadogProcCgroup":  &finder.Cgroup,
+	}
+	for setting, pattern := range patterns {
+		if viper.GetString(setting) == "" {
+			continue
+		}
+		compiled, err := regexp.Compile(viper.GetString(setting))
+		if err != nil {
+			return finder, fmt.Errorf("invalid %s '%s': %v", setting, viper.GetString(setting), err)
+		}
+		*pattern = compiled
+	}
+	// matching on the command line or executable is more precise than the name, so it takes the name's place
+	if finder.Cmdline == nil && finder.Exe == nil {
+		finder.Name = viper.GetString("datadogProcName")
+	}
+	return finder, nil
+}
+
+// Reload will get datadog to pick up new configs using the reload strategy our settings ask for.  If we have a
+// verifyCommand we then make sure datadog actually loaded our configs, unless ctx is done before it is time to.  It
+// returns true if datadog was reloaded (and verified, if we were asked to and had the time)
+func Reload(ctx context.Context) bool {
+	// log errors to stderr
+	logger := log.New(os.Stderr, log.Prefix(), 0)
+	strategy, err := NewReloadStrategy()
+	if err != nil {
+		logger.Println(err)
+		logger.Println("Datadog Reload Skipped.")
+		return false
+	}
+	err = strategy.Reload()
+	if err != nil {
+		logger.Println(err)
+		logger.Printf("Could not reload datadog by %s. Datadog Reload Skipped.\n", strategy)
+		return false
+	}
+
+	if viper.GetString("verifyCommand") == "" {
+		return true
+	}
+	// give datadog a chance to load (and run) our checks before we ask it how they went.  We don't hold up shutting
+	// down to do that though
+	select {
+	case <-time.After(time.Duration(viper.GetInt64("verifyDelay")) * time.Second):
+		return VerifyReload()
+	case <-ctx.Done():
+		log.Println("Shutting down. Skipped verifying that datadog loaded our configs.")
+		return true
+	}
+}
+
+// SignalByPidFile reloads datadog by sending a HUP signal to the process whose pid is in PidFile
+type SignalByPidFile struct {
+	PidFile string
+}
+
+// Reload sends the signal
+func (strategy SignalByPidFile) Reload() error {
+	pidBytes, err := ioutil.ReadFile(strategy.PidFile)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+	if err != nil {
+		return fmt.Errorf("%s does not contain a pid: %v", strategy.PidFile, err)
+	}
+	osProcess, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	err = osProcess.Signal(syscall.SIGHUP)
+	if err != nil {
+		return fmt.Errorf("failed to send reload signal to %d: %v", pid, err)
+	}
+	log.Printf("Reloaded %d (from %s)\n", pid, strategy.PidFile)
+	return nil
+}
+
+func (strategy SignalByPidFile) String() string {
+	return fmt.Sprintf("signaling the process in %s", strategy.PidFile)
+}
+
+// RunCommand reloads datadog by running Command in a shell (e.g. systemctl reload datadog-agent).  The command is
+// killed if it takes longer than Timeout
+type RunCommand struct {
+	Command string
+	Timeout time.Duration
+}
+
+// Reload runs the command.  Its output is logged either way so that problems can be tracked down
+func (strategy RunCommand) Reload() error {
+	output, err := runCommand(strategy.Command, strategy.Timeout)
+	if err != nil {
+		return err
+	}
+	log.Printf("Reloaded with '%s'. Output: %s\n", strategy.Command, strings.TrimSpace(output))
+	return nil
+}
+
+// runCommand runs command in a shell and returns everything it wrote.  The command is killed if it takes longer than
+// timeout.  Its output is included in any error so that problems can be tracked down
+func runCommand(commandLine string, timeout time.Duration) (string, error) {
+	command := exec.Command("/bin/sh", "-c", commandLine)
+	output := new(bytes.Buffer)
+	command.Stdout = output
+	command.Stderr = output
+	// the command gets its own process group so that anything it starts is killed along with it
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := command.Start()
+	if err != nil {
+		return "", err
+	}
+
+	finished := make(chan error, 1)
+	go func() {
+		finished <- command.Wait()
+	}()
+	select {
+	case err = <-finished:
+	case <-time.After(timeout):
+		syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+		<-finished
+		return output.String(), fmt.Errorf("'%s' did not finish within %s. Output: %s", commandLine, timeout, strings.TrimSpace(output.String()))
+	}
+	if err != nil {
+		return output.String(), fmt.Errorf("'%s' failed (%v). Output: %s", commandLine, err, strings.TrimSpace(output.String()))
+	}
+	return output.String(), nil
+}
+
+func (strategy RunCommand) String() string {
+	return fmt.Sprintf("running '%s'", strategy.Command)
+}
+
+// HTTPRequest reloads datadog by making a request to URL.  Any 2xx response counts as success
+type HTTPRequest struct {
+	URL     string
+	Method  string
+	Timeout time.Duration
+}
+
+// Reload makes the request
+func (strategy HTTPRequest) Reload() error {
+	request, err := http.NewRequest(strategy.Method, strategy.URL, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: strategy.Timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// we only need enough of the body to explain what went wrong
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s: %s", strategy.Method, strategy.URL, response.Status, strings.TrimSpace(string(body)))
+	}
+	log.Printf("Reloaded with %s %s (%s)\n", strategy.Method, strategy.URL, response.Status)
+	return nil
+}
+
+func (strategy HTTPRequest) String() string {
+	return fmt.Sprintf("requesting %s %s", strategy.Method, strategy.URL)
+}
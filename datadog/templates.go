@@ -0,0 +1,315 @@
+package datadog
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/spf13/viper"
+)
+
+// cachedTemplate is a template we have downloaded before, along with what we need to ask for it again
+type cachedTemplate struct {
+	Body         []byte    `json:"body"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Checksum     string    `json:"checksum,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// templateCache holds every template we have downloaded keyed on its uri.  It is backed by files in the template cache
+// folder so that we still have our templates after a restart, even if the place we got them from is down
+var templateCache = struct {
+	sync.Mutex
+	templates map[string]*cachedTemplate
+}{
+	templates: make(map[string]*cachedTemplate),
+}
+
+// templateClient is used for all of our http(s) template downloads
+var templateClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetchTemplate will return the raw content of the template at uri.  Templates are only downloaded again once they
+// are older than the templateCacheTTL, and http(s) templates are only transferred again if they have changed.  If we
+// cannot download a template we fall back to the last copy we got
+func fetchTemplate(uri string) ([]byte, error) {
+	// log errors to stderr
+	logger := log.New(os.Stderr, log.Prefix(), 0)
+	templateCache.Lock()
+	defer templateCache.Unlock()
+
+	cached := loadCachedTemplate(uri)
+	ttl := time.Duration(viper.GetInt64("templateCacheTTL")) * time.Second
+	if cached != nil && time.Since(cached.Fetched) < ttl {
+		return cached.Body, nil
+	}
+
+	fresh, err := downloadTemplate(uri, cached)
+	if err != nil {
+		if cached == nil {
+			return nil, err
+		}
+		logger.Println(err)
+		logger.Printf("Could not refresh template %s. Using the copy from %s.\n", uri, cached.Fetched.Format(time.RFC3339))
+		return cached.Body, nil
+	}
+
+	storeCachedTemplate(uri, fresh)
+	return fresh.Body, nil
+}
+
+// downloadTemplate will get a fresh copy of the template at uri.  If we have a cached copy and the uri is http(s), we
+// send a conditional request and reuse the cached body if the server says it has not changed
+func downloadTemplate(uri string, cached *cachedTemplate) (*cachedTemplate, error) {
+	// pull any checksum we have been asked to verify out of the uri
+	downloadURI, checksum := splitChecksum(uri)
+
+	// anything that is not http(s) is handed to go-getter, which will verify the checksum itself
+	if !strings.HasPrefix(downloadURI, "http://") && !strings.HasPrefix(downloadURI, "https://") {
+		body, err := getTemplateFile(uri)
+		if err != nil {
+			return nil, err
+		}
+		if checksum != "" {
+			log.Printf("Template %s matched checksum %s\n", downloadURI, checksum)
+		}
+		return &cachedTemplate{
+			Body:     body,
+			Checksum: checksum,
+			Fetched:  time.Now(),
+		}, nil
+	}
+
+	request, err := http.NewRequest("GET", downloadURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			request.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			request.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	response, err := templateClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	// if the template has not changed we just note that we checked
+	if response.StatusCode == http.StatusNotModified && cached != nil {
+		fresh := *cached
+		fresh.Fetched = time.Now()
+		return &fresh, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad response code downloading %s: %d", downloadURI, response.StatusCode)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != "" {
+		err = verifyChecksum(body, checksum)
+		if err != nil {
+			return nil, fmt.Errorf("template %s did not match its checksum: %v", downloadURI, err)
+		}
+		log.Printf("Template %s matched checksum %s\n", downloadURI, checksum)
+	}
+	return &cachedTemplate{
+		Body:         body,
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+		Checksum:     checksum,
+		Fetched:      time.Now(),
+	}, nil
+}
+
+// getTemplateFile will use go-getter to download the template at uri into our temp folder and return its content
+func getTemplateFile(uri string) ([]byte, error) {
+	// first generate a temp filename
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	randomString := base64.RawURLEncoding.EncodeToString(b)
+	templatePath := path.Join(viper.GetString("tempFolder"), fmt.Sprintf("%s.%s", path.Base(uri), randomString))
+	// we never want to leave the temp file around
+	defer os.Remove(templatePath)
+
+	// then download the template file from the url provided
+	err = getter.GetFile(templatePath, uri)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(templatePath)
+}
+
+// splitChecksum removes the checksum query parameter (in the same format go-getter uses) from uri and returns the
+// remaining uri along with the checksum
+func splitChecksum(uri string) (string, string) {
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return uri, ""
+	}
+	query := parsedURI.Query()
+	checksum := query.Get("checksum")
+	if checksum == "" {
+		return uri, ""
+	}
+	query.Del("checksum")
+	parsedURI.RawQuery = query.Encode()
+	return parsedURI.String(), checksum
+}
+
+// verifyChecksum makes sure body matches checksum.  The checksum is either <type>:<value> where type is one of md5,
+// sha1, sha256 or sha512, or just the value, in which case the type is worked out from its length
+func verifyChecksum(body []byte, checksum string) error {
+	checksumType := ""
+	checksumValue := checksum
+	if parts := strings.SplitN(checksum, ":", 2); len(parts) == 2 {
+		checksumType = parts[0]
+		checksumValue = parts[1]
+	} else {
+		switch len(checksum) {
+		case md5.Size * 2:
+			checksumType = "md5"
+		case sha1.Size * 2:
+			checksumType = "sha1"
+		case sha256.Size * 2:
+			checksumType = "sha256"
+		case sha512.Size * 2:
+			checksumType = "sha512"
+		}
+	}
+
+	var hasher hash.Hash
+	switch checksumType {
+	case "md5":
+		hasher = md5.New()
+	case "sha1":
+		hasher = sha1.New()
+	case "sha256":
+		hasher = sha256.New()
+	case "sha512":
+		hasher = sha512.New()
+	default:
+		return fmt.Errorf("unsupported checksum %s", checksum)
+	}
+
+	hasher.Write(body)
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != strings.ToLower(checksumValue) {
+		return fmt.Errorf("expected %s got %s", checksumValue, actual)
+	}
+	return nil
+}
+
+// templateCacheFolder returns the folder we keep our on disk copies of templates in.  The default folder has our user
+// id in its name since the temp folder is usually shared with other users
+func templateCacheFolder() string {
+	if folder := viper.GetString("templateCacheFolder"); folder != "" {
+		return folder
+	}
+	return path.Join(viper.GetString("tempFolder"), fmt.Sprintf("consuldog-templates-%d", os.Geteuid()))
+}
+
+// checkTemplateCacheFolder makes sure nobody else could have put templates in our cache folder.  It has to be a real
+// folder (not a link) that belongs to us, and that only we can write to
+func checkTemplateCacheFolder() error {
+	folder := templateCacheFolder()
+	info, err := os.Lstat(folder)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("template cache folder %s is not a folder", folder)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("template cache folder %s belongs to user %d rather than us", folder, stat.Uid)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("template cache folder %s can be written to by other users (mode %s)", folder, info.Mode().Perm())
+	}
+	return nil
+}
+
+// templateCachePath returns the path to the on disk copy of the template at uri
+func templateCachePath(uri string) string {
+	uriHash := sha256.Sum256([]byte(uri))
+	return path.Join(templateCacheFolder(), fmt.Sprintf("%s.json", hex.EncodeToString(uriHash[:])))
+}
+
+// loadCachedTemplate returns our cached copy of the template at uri, first checking memory and then disk.  It returns
+// nil if we don't have one
+func loadCachedTemplate(uri string) *cachedTemplate {
+	if cached, found := templateCache.templates[uri]; found {
+		return cached
+	}
+
+	// we don't use anything on disk unless we know it was put there by us
+	if checkTemplateCacheFolder() != nil {
+		return nil
+	}
+	cacheBytes, err := ioutil.ReadFile(templateCachePath(uri))
+	if err != nil {
+		return nil
+	}
+	var cached cachedTemplate
+	err = json.Unmarshal(cacheBytes, &cached)
+	if err != nil {
+		return nil
+	}
+	// if the template is pinned we don't trust what is on disk unless it still matches
+	if _, checksum := splitChecksum(uri); checksum != "" && verifyChecksum(cached.Body, checksum) != nil {
+		return nil
+	}
+	templateCache.templates[uri] = &cached
+	return &cached
+}
+
+// storeCachedTemplate saves our copy of the template at uri to memory and disk.  Failing to write the disk copy only
+// costs us the ability to survive a restart so we just log it
+func storeCachedTemplate(uri string, cached *cachedTemplate) {
+	// log errors to stderr
+	logger := log.New(os.Stderr, log.Prefix(), 0)
+	templateCache.templates[uri] = cached
+
+	cacheBytes, err := json.Marshal(cached)
+	if err != nil {
+		logger.Println(err)
+		return
+	}
+	err = os.MkdirAll(templateCacheFolder(), 0700)
+	if err == nil {
+		err = checkTemplateCacheFolder()
+	}
+	if err == nil {
+		err = writeFileAtomic(templateCachePath(uri), cacheBytes, 0600, -1)
+	}
+	if err != nil {
+		logger.Println(err)
+		logger.Printf("Warning: Could not save a copy of template %s to disk.\n", uri)
+	}
+}
@@ -0,0 +1,230 @@
+package datadog
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ValidationError describes a single problem found with a template
+type ValidationError struct {
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// TemplateValidation holds the result of validating a single template
+type TemplateValidation struct {
+	Template string            `json:"template"`
+	Valid    bool              `json:"valid"`
+	Errors   []ValidationError `json:"errors"`
+}
+
+// LintTemplate runs the template at uri through the same checks we use before using a template, and then through a
+// number of stricter checks for things that would otherwise be silently ignored
+func LintTemplate(uri string, datadogType string) TemplateValidation {
+	validation := TemplateValidation{
+		Template: uri,
+		Errors:   make([]ValidationError, 0),
+	}
+	addError := func(check string, err error) {
+		validation.Errors = append(validation.Errors, ValidationError{
+			Check:   check,
+			Message: err.Error(),
+		})
+	}
+
+	tmpl, err := ParseTemplate(uri)
+	if err != nil {
+		addError("parse", err)
+		return validation
+	}
+
+	// look for fields that don't exist anywhere in the template, not just in the parts a test service reaches
+	dud := dudMonitor(uri, datadogType)
+	for _, err := range checkFields(tmpl, tmpl.Root, reflect.TypeOf(templateData(dud)), reflect.TypeOf(templateData(dud))) {
+		addError("fields", err)
+	}
+
+	// then render it just like we would before using it
+	rendered, err := ValidateTemplate(tmpl, datadogType)
+	if err != nil {
+		addError("render", err)
+		validation.Valid = len(validation.Errors) == 0
+		return validation
+	}
+
+	// datadog ignores keys it does not know about, which usually means a typo
+	var topLevel map[string]interface{}
+	err = yaml.Unmarshal(rendered, &topLevel)
+	if err == nil {
+		known := checkConfKeys()
+		for key := range topLevel {
+			if !known[key] {
+				addError("keys", fmt.Errorf("unknown top level key '%s'", key))
+			}
+		}
+	}
+
+	// and a config without instances or logs does not monitor anything
+	var config CheckConf
+	err = yaml.Unmarshal(rendered, &config)
+	if err == nil && config.empty() {
+		addError("instances", fmt.Errorf("template does not produce any instances or logs"))
+	}
+
+	validation.Valid = len(validation.Errors) == 0
+	return validation
+}
+
+// checkConfKeys returns the top level keys a CheckConf understands
+func checkConfKeys() map[string]bool {
+	keys := make(map[string]bool)
+	confType := reflect.TypeOf(CheckConf{})
+	for index := 0; index < confType.NumField(); index++ {
+		keys[strings.Split(confType.Field(index).Tag.Get("yaml"), ",")[0]] = true
+	}
+	return keys
+}
+
+// checkFields walks the parse tree of tmpl starting at node and returns an error for every field that does not exist
+// on the data it will be evaluated against.  dot is the type of the data at node, and root is the type of the data
+// the template is executed with.  A nil type means we can't work out what the data will be, so it is not checked
+func checkFields(tmpl *template.Template, node parse.Node, dot reflect.Type, root reflect.Type) []error {
+	errs := make([]error, 0)
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			break
+		}
+		for _, child := range node.Nodes {
+			errs = append(errs, checkFields(tmpl, child, dot, root)...)
+		}
+	case *parse.ActionNode:
+		errs = append(errs, checkFields(tmpl, node.Pipe, dot, root)...)
+	case *parse.IfNode:
+		errs = append(errs, checkFields(tmpl, node.Pipe, dot, root)...)
+		errs = append(errs, checkFields(tmpl, node.List, dot, root)...)
+		errs = append(errs, checkFields(tmpl, node.ElseList, dot, root)...)
+	case *parse.WithNode:
+		errs = append(errs, checkFields(tmpl, node.Pipe, dot, root)...)
+		errs = append(errs, checkFields(tmpl, node.List, pipeType(node.Pipe, dot, root), root)...)
+		errs = append(errs, checkFields(tmpl, node.ElseList, dot, root)...)
+	case *parse.RangeNode:
+		errs = append(errs, checkFields(tmpl, node.Pipe, dot, root)...)
+		errs = append(errs, checkFields(tmpl, node.List, elemType(pipeType(node.Pipe, dot, root)), root)...)
+		errs = append(errs, checkFields(tmpl, node.ElseList, dot, root)...)
+	case *parse.PipeNode:
+		if node == nil {
+			break
+		}
+		for _, command := range node.Cmds {
+			for _, arg := range command.Args {
+				errs = append(errs, checkFields(tmpl, arg, dot, root)...)
+			}
+		}
+	case *parse.FieldNode:
+		if _, err := fieldType(dot, node.Ident); err != nil {
+			location, _ := tmpl.ErrorContext(node)
+			errs = append(errs, fmt.Errorf("%s: %v", location, err))
+		}
+	case *parse.VariableNode:
+		// $ is always the data the template was executed with.  We can't follow any other variables
+		if node.Ident[0] == "$" && len(node.Ident) > 1 {
+			if _, err := fieldType(root, node.Ident[1:]); err != nil {
+				location, _ := tmpl.ErrorContext(node)
+				errs = append(errs, fmt.Errorf("%s: %v", location, err))
+			}
+		}
+	}
+	return errs
+}
+
+// pipeType works out the type a pipeline will produce, if it is simple enough for us to follow
+func pipeType(pipe *parse.PipeNode, dot reflect.Type, root reflect.Type) reflect.Type {
+	if pipe == nil || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return nil
+	}
+	switch arg := pipe.Cmds[0].Args[0].(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		fieldType, _ := fieldType(dot, arg.Ident)
+		return fieldType
+	case *parse.VariableNode:
+		if arg.Ident[0] == "$" {
+			fieldType, _ := fieldType(root, arg.Ident[1:])
+			return fieldType
+		}
+	}
+	return nil
+}
+
+// elemType returns the type of the items a range over dataType will produce
+func elemType(dataType reflect.Type) reflect.Type {
+	dataType = indirectType(dataType)
+	if dataType == nil {
+		return nil
+	}
+	switch dataType.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return dataType.Elem()
+	}
+	return nil
+}
+
+// fieldType follows a chain of field names (e.g. .Monitor.DatadogType) from dataType and returns the type at the end
+// of it, or an error if one of the fields does not exist
+func fieldType(dataType reflect.Type, chain []string) (reflect.Type, error) {
+	for _, name := range chain {
+		if dataType == nil {
+			return nil, nil
+		}
+		// methods can be on the pointer or the value
+		if method, found := dataType.MethodByName(name); found {
+			dataType = methodType(method)
+			continue
+		}
+		dataType = indirectType(dataType)
+		if method, found := reflect.PtrTo(dataType).MethodByName(name); found {
+			dataType = methodType(method)
+			continue
+		}
+		switch dataType.Kind() {
+		case reflect.Struct:
+			field, found := dataType.FieldByName(name)
+			if !found || field.PkgPath != "" {
+				return nil, fmt.Errorf("can't evaluate field %s in type %s", name, dataType)
+			}
+			dataType = field.Type
+		case reflect.Map:
+			// any key is allowed in a map
+			dataType = dataType.Elem()
+		case reflect.Interface:
+			// interfaces could be anything
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("can't evaluate field %s in type %s", name, dataType)
+		}
+	}
+	return dataType, nil
+}
+
+// methodType returns the type of the first value returned by method
+func methodType(method reflect.Method) reflect.Type {
+	if method.Type.NumOut() == 0 {
+		return nil
+	}
+	return method.Type.Out(0)
+}
+
+// indirectType follows pointers until it gets to something that isn't one
+func indirectType(dataType reflect.Type) reflect.Type {
+	for dataType != nil && dataType.Kind() == reflect.Ptr {
+		dataType = dataType.Elem()
+	}
+	return dataType
+}
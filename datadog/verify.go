@@ -0,0 +1,159 @@
+package datadog
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/spf13/viper"
+)
+
+// agentCheckStatus is what the datadog agent told us about a check
+type agentCheckStatus struct {
+	Loaded bool
+	Errors []string
+}
+
+// configcheckHeader is the line `datadog-agent configcheck` starts each loaded check with (e.g. === apache check ===)
+var configcheckHeader = regexp.MustCompile(`^=== (\S+) check ===$`)
+
+// underline matches the lines the agent's status and info commands put under their headings
+var underline = regexp.MustCompile(`^\s*(=+|-+)\s*$`)
+
+// VerifyReload runs our verifyCommand and checks its output to make sure datadog loaded every check we generated a
+// config for.  Every check that did not load is logged, and it returns false if there were any
+func VerifyReload() bool {
+	// log errors to stderr
+	logger := log.New(os.Stderr, log.Prefix(), 0)
+	verifyCommand := viper.GetString("verifyCommand")
+	output, err := runCommand(verifyCommand, time.Duration(viper.GetInt64("reloadTimeout"))*time.Second)
+	if err != nil {
+		logger.Println(err)
+		logger.Println("Could not verify that datadog loaded our configs.")
+		return false
+	}
+
+	statuses := parseAgentOutput(output)
+	checks := generatedChecks()
+	verified := true
+	for _, check := range checks {
+		status, found := statuses[check]
+		if found && len(status.Errors) > 0 {
+			logger.Printf("Datadog could not load the %s check: %s\n", check, strings.Join(status.Errors, " "))
+			verified = false
+		} else if !found || !status.Loaded {
+			logger.Printf("Datadog did not report the %s check as loaded.\n", check)
+			verified = false
+		}
+	}
+	if verified {
+		log.Printf("Verified that datadog loaded %d checks\n", len(checks))
+	}
+	return verified
+}
+
+// generatedChecks returns the names of the datadog checks we have generated config files for, in order.  Files that
+// only collect logs are left out since the agent does not report them as checks
+func generatedChecks() []string {
+	found := make(map[string]bool)
+	for _, configPath := range ownedConfigFiles() {
+		configBytes, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			continue
+		}
+		var config CheckConf
+		if yaml.Unmarshal(configBytes, &config) != nil || len(config.Instances) == 0 {
+			continue
+		}
+		found[checkName(configPath)] = true
+	}
+	checks := make([]string, 0, len(found))
+	for check := range found {
+		checks = append(checks, check)
+	}
+	sort.Strings(checks)
+	return checks
+}
+
+// checkName works out the name of the datadog check a config file is for, in either layout
+func checkName(configPath string) string {
+	folder := path.Base(path.Dir(configPath))
+	if strings.HasSuffix(folder, ".d") && folder != "conf.d" {
+		return strings.TrimSuffix(folder, ".d")
+	}
+	return strings.TrimSuffix(path.Base(configPath), path.Ext(configPath))
+}
+
+// parseAgentOutput works out which checks loaded, and which ran into errors, from the output of the agent's
+// configcheck, status (agent 6 and later) or info (agent 5) commands.  Those look quite different, but they all list
+// checks under headings (either "=== <check> check ===", or a line underlined with dashes), and they all put problems
+// under headings with "Error" in their name, or mark them with [ERROR]
+func parseAgentOutput(output string) map[string]*agentCheckStatus {
+	statuses := make(map[string]*agentCheckStatus)
+	status := func(check string) *agentCheckStatus {
+		if _, found := statuses[check]; !found {
+			statuses[check] = &agentCheckStatus{Errors: make([]string, 0)}
+		}
+		return statuses[check]
+	}
+
+	lines := strings.Split(output, "\n")
+	// the section (underlined with =) and check (underlined with -) we are in
+	section := ""
+	check := ""
+	for index, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || underline.MatchString(line) {
+			continue
+		}
+		// configcheck lists each check that loaded, followed by a section for configs that could not be loaded
+		if header := configcheckHeader.FindStringSubmatch(trimmed); header != nil {
+			status(header[1]).Loaded = true
+			section = ""
+			check = header[1]
+			continue
+		}
+		if strings.HasPrefix(trimmed, "===") {
+			section = strings.Trim(trimmed, "= ")
+			check = ""
+			continue
+		}
+		// status and info underline their headings
+		if index+1 < len(lines) && underline.MatchString(lines[index+1]) {
+			if strings.HasPrefix(strings.TrimSpace(lines[index+1]), "=") {
+				section = trimmed
+				check = ""
+			} else {
+				// check headings can have a version after the name (e.g. apache (1.2.0))
+				check = strings.Fields(trimmed)[0]
+			}
+			continue
+		}
+
+		inErrors := strings.Contains(strings.ToLower(section), "error")
+		switch {
+		case inErrors && check != "":
+			status(check).Errors = append(status(check).Errors, trimmed)
+		case inErrors:
+			// configcheck lists its errors as <check>: <error>
+			parts := strings.SplitN(trimmed, ":", 2)
+			if len(parts) == 2 && !strings.ContainsAny(parts[0], " \t") {
+				status(parts[0]).Errors = append(status(parts[0]).Errors, strings.TrimSpace(parts[1]))
+			}
+		case check != "" && strings.Contains(trimmed, "[ERROR]"):
+			status(check).Errors = append(status(check).Errors, trimmed)
+		case check != "" && strings.HasPrefix(trimmed, "Error:") && len(status(check).Errors) > 0:
+			status(check).Errors = append(status(check).Errors, trimmed)
+		case check != "" && (strings.Contains(trimmed, "[OK]") || strings.Contains(trimmed, "[WARNING]")):
+			status(check).Loaded = true
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,365 @@
+package datadog
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// configcheckOutput is what `datadog-agent configcheck` prints when apache and nginx loaded but redisdb did not
+const configcheckOutput = `=== apache check ===
+Configuration provider: file
+Configuration source: file:/etc/datadog-agent/conf.d/apache.d/consuldog-node1__web.yaml
+Instance ID: apache:4b9c7d6a3e1f2a10
+apache_status_url: http://10.0.0.1:80/server-status?auto
+tags:
+- consul_service:web
+~
+Auto-discovery IDs:
+* web
+===
+
+=== nginx check ===
+Configuration provider: file
+Configuration source: file:/etc/datadog-agent/conf.d/nginx.d/consuldog-node1__proxy.yaml
+Instance ID: nginx:1f0a3b5c7d9e2468
+nginx_status_url: http://10.0.0.2:8080/nginx_status
+~
+===
+
+=== Configuration errors ===
+
+redisdb: yaml: line 3: mapping values are not allowed in this context
+`
+
+// statusOutput is part of what `datadog-agent status` prints when apache ran fine, mysql ran into an error, and redisdb
+// and postgres could not be loaded at all
+const statusOutput = `Getting the status from the agent.
+
+===============
+Agent (v6.12.0)
+===============
+
+  Status date: 2019-06-18 15:04:05.123456 UTC
+  Pid: 12345
+  Python Version: 2.7.16
+
+=========
+Collector
+=========
+
+  Running Checks
+  ==============
+
+    apache (1.6.0)
+    --------------
+      Instance ID: apache:4b9c7d6a3e1f2a10 [OK]
+      Total Runs: 12
+      Metric Samples: Last Run: 10, Total: 120
+      Events: Last Run: 0, Total: 0
+      Service Checks: Last Run: 1, Total: 12
+      Average Execution Time : 5ms
+
+    mysql (1.9.0)
+    -------------
+      Instance ID: mysql:8e2d4f6a0c1b3d5e [ERROR]
+      Total Runs: 12
+      Metric Samples: Last Run: 0, Total: 0
+      Error: (1045, "Access denied for user 'datadog'@'10.0.0.3' (using password: YES)")
+      Traceback (most recent call last):
+        File "/opt/datadog-agent/embedded/lib/python2.7/site-packages/datadog_checks/base/checks/base.py", line 678, in run
+          self.check(instance)
+
+    ntp
+    ---
+      Instance ID: ntp:d884b5186b651429 [WARNING]
+      Total Runs: 12
+      Warning: No ntp response received
+
+  Config Errors
+  ==============
+    redisdb
+    -------
+      yaml: line 3: mapping values are not allowed in this context
+
+  Loading Errors
+  ==============
+    postgres
+    --------
+      Core Check Loader:
+        Check postgres not found in Catalog
+
+      Python Check Loader:
+        No module named postgres
+
+========
+JMXFetch
+========
+
+  Initialized checks
+  ==================
+    no checks
+`
+
+// infoOutput is part of what `dd-agent info` (agent 5) prints when apache ran fine, and mysql and redisdb ran into
+// errors
+const infoOutput = `====================
+Collector (v 5.32.0)
+====================
+
+  Status date: 2019-06-18 15:04:05 (5s ago)
+  Pid: 12345
+  Platform: Linux-4.15.0-x86_64-with-Ubuntu-18.04-bionic
+  Python Version: 2.7.16, 64bit
+
+  Checks
+  ======
+
+    apache (5.32.0)
+    ---------------
+      - instance #0 [OK]
+      - Collected 10 metrics, 0 events & 1 service check
+
+    mysql (5.32.0)
+    --------------
+      - instance #0 [ERROR]: OperationalError(1045, "Access denied for user 'datadog'@'10.0.0.3'")
+      - Collected 0 metrics, 0 events & 1 service check
+
+    redisdb (5.32.0)
+    ----------------
+      - initialize check class [ERROR]: Exception('You need to specify a host or a unix_socket')
+
+  Emitters
+  ========
+
+    - http_emitter [OK]
+
+====================
+Dogstatsd (v 5.32.0)
+====================
+
+  Status date: 2019-06-18 15:04:01 (9s ago)
+`
+
+func TestParseAgentOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		expected map[string]*agentCheckStatus
+	}{
+		{
+			name:     "no output",
+			output:   "",
+			expected: map[string]*agentCheckStatus{},
+		},
+		{
+			name:   "configcheck",
+			output: configcheckOutput,
+			expected: map[string]*agentCheckStatus{
+				"apache":  {Loaded: true, Errors: []string{}},
+				"nginx":   {Loaded: true, Errors: []string{}},
+				"redisdb": {Errors: []string{"yaml: line 3: mapping values are not allowed in this context"}},
+			},
+		},
+		{
+			name:   "status",
+			output: statusOutput,
+			expected: map[string]*agentCheckStatus{
+				"apache": {Loaded: true, Errors: []string{}},
+				"mysql": {Errors: []string{
+					"Instance ID: mysql:8e2d4f6a0c1b3d5e [ERROR]",
+					`Error: (1045, "Access denied for user 'datadog'@'10.0.0.3' (using password: YES)")`,
+				}},
+				"ntp":      {Loaded: true, Errors: []string{}},
+				"redisdb":  {Errors: []string{"yaml: line 3: mapping values are not allowed in this context"}},
+				"postgres": {Errors: []string{"Core Check Loader:", "Check postgres not found in Catalog", "Python Check Loader:", "No module named postgres"}},
+			},
+		},
+		{
+			name:   "info",
+			output: infoOutput,
+			expected: map[string]*agentCheckStatus{
+				"apache":  {Loaded: true, Errors: []string{}},
+				"mysql":   {Errors: []string{`- instance #0 [ERROR]: OperationalError(1045, "Access denied for user 'datadog'@'10.0.0.3'")`}},
+				"redisdb": {Errors: []string{"- initialize check class [ERROR]: Exception('You need to specify a host or a unix_socket')"}},
+			},
+		},
+		{
+			name: "configcheck with only errors",
+			output: `=== Configuration errors ===
+
+apache: open /etc/datadog-agent/conf.d/apache.d/consuldog-node1__web.yaml: permission denied
+not a check line
+nginx:yaml: unmarshal errors
+`,
+			expected: map[string]*agentCheckStatus{
+				"apache": {Errors: []string{"open /etc/datadog-agent/conf.d/apache.d/consuldog-node1__web.yaml: permission denied"}},
+				"nginx":  {Errors: []string{"yaml: unmarshal errors"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statuses := parseAgentOutput(test.output)
+			if !reflect.DeepEqual(statuses, test.expected) {
+				for check, status := range statuses {
+					t.Logf("%s: %+v", check, *status)
+				}
+				t.Errorf("unexpected statuses")
+			}
+		})
+	}
+}
+
+// useSettings sets each of settings in viper, and returns a function that puts them back the way they were
+func useSettings(settings map[string]interface{}) func() {
+	previous := make(map[string]interface{})
+	for key, value := range settings {
+		previous[key] = viper.Get(key)
+		viper.Set(key, value)
+	}
+	return func() {
+		for key, value := range previous {
+			viper.Set(key, value)
+		}
+	}
+}
+
+// fakeDatadogFolder builds a datadog folder holding config files for apache and nginx that we generated, a logs only
+// config we generated, and a config for mysql that we did not.  It returns its path
+func fakeDatadogFolder(t *testing.T) string {
+	folder, err := ioutil.TempDir("", "consuldog-datadog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"conf.d/apache.d/consuldog-node1__web.yaml":  generatedHeader + "init_config:\ninstances:\n- apache_status_url: http://10.0.0.1/server-status?auto\n",
+		"conf.d/nginx.d/consuldog-node1__proxy.yaml": generatedHeader + "init_config:\ninstances:\n- nginx_status_url: http://10.0.0.2/nginx_status\n",
+		"conf.d/syslog.d/consuldog-node1__web.yaml":  generatedHeader + "init_config:\nlogs:\n- type: file\n  path: /var/log/web.log\n",
+		"conf.d/mysql.yaml":                          "init_config:\ninstances:\n- server: localhost\n",
+	}
+	for file, content := range files {
+		writeFakeFile(t, path.Join(folder, file), content)
+	}
+	return folder
+}
+
+// stubCommand writes a script that prints output and exits with exitCode, and returns the command to run it
+func stubCommand(t *testing.T, folder string, output string, exitCode string) string {
+	writeFakeFile(t, path.Join(folder, "agent-output"), output)
+	script := path.Join(folder, "agent")
+	err := ioutil.WriteFile(script, []byte("#!/bin/sh\ncat "+path.Join(folder, "agent-output")+"\nexit "+exitCode+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script + " configcheck"
+}
+
+func TestVerifyReload(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		exitCode string
+		expected bool
+	}{
+		{
+			name:     "everything loaded",
+			output:   configcheckOutput,
+			exitCode: "0",
+			expected: true,
+		},
+		{
+			name: "everything loaded in the status output",
+			output: `  Running Checks
+  ==============
+    apache (1.6.0)
+    --------------
+      Instance ID: apache:4b9c7d6a3e1f2a10 [OK]
+    nginx (2.1.0)
+    -------------
+      Instance ID: nginx:1f0a3b5c7d9e2468 [OK]
+`,
+			exitCode: "0",
+			expected: true,
+		},
+		{
+			name:     "a check is missing",
+			output:   "=== apache check ===\nInstance ID: apache:4b9c7d6a3e1f2a10\n===\n",
+			exitCode: "0",
+			expected: false,
+		},
+		{
+			name:     "a check has errors",
+			output:   configcheckOutput + "nginx: yaml: line 2: did not find expected key\n",
+			exitCode: "0",
+			expected: false,
+		},
+		{
+			name:     "the command fails",
+			output:   configcheckOutput,
+			exitCode: "1",
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			folder := fakeDatadogFolder(t)
+			defer os.RemoveAll(folder)
+			restore := useSettings(map[string]interface{}{
+				"datadogFolder": folder,
+				"verifyCommand": stubCommand(t, folder, test.output, test.exitCode),
+				"reloadTimeout": 10,
+			})
+			defer restore()
+
+			if verified := VerifyReload(); verified != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, verified)
+			}
+		})
+	}
+}
+
+func TestGeneratedChecks(t *testing.T) {
+	folder := fakeDatadogFolder(t)
+	defer os.RemoveAll(folder)
+	restore := useSettings(map[string]interface{}{"datadogFolder": folder})
+	defer restore()
+
+	// the logs only config and the config we did not generate are left out
+	checks := generatedChecks()
+	if !reflect.DeepEqual(checks, []string{"apache", "nginx"}) {
+		t.Errorf("expected [apache nginx], got %v", checks)
+	}
+}
+
+func TestReloadDoesNotWaitToVerifyWhenShuttingDown(t *testing.T) {
+	folder := fakeDatadogFolder(t)
+	defer os.RemoveAll(folder)
+	restore := useSettings(map[string]interface{}{
+		"datadogFolder":  folder,
+		"reloadStrategy": ReloadCommand,
+		"reloadCommand":  "true",
+		"reloadTimeout":  10,
+		"verifyCommand":  stubCommand(t, folder, "", "1"),
+		"verifyDelay":    60,
+	})
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	started := time.Now()
+	if !Reload(ctx) {
+		t.Error("expected the reload to succeed")
+	}
+	if waited := time.Since(started); waited > 5*time.Second {
+		t.Errorf("expected Reload to stop waiting when cancelled, but it took %s", waited)
+	}
+}
@@ -8,14 +8,44 @@ import (
 type Monitor struct {
 	ConfigTemplate string
 	DatadogType    string
-	Service        *Service
+	// Params holds any extra settings that were provided along with the monitor definition
+	Params map[string]string
+	// Index is the position of the monitor in its service's list of monitors
+	Index   int
+	Service *Service
 }
 
+// the ways we can treat services whose consul health checks are failing
+const (
+	// HealthModeIgnore monitors every service regardless of its health
+	HealthModeIgnore = "ignore"
+	// HealthModeSkip leaves unhealthy services out of the datadog configs
+	HealthModeSkip = "skip"
+	// HealthModeTag monitors unhealthy services, but tags their instances with their health
+	HealthModeTag = "tag"
+)
+
 // Service contains details of services for a particular node, as well as the templates to use for that service
 type Service struct {
 	consul.AgentService
 	Monitors []Monitor
 	Node     string
+	// NodeInfo holds the details consul has about the node the service is on
+	NodeInfo consul.Node
+	// Health is the aggregate status of the consul health checks for this service (only set if we are health aware)
+	Health string
+}
+
+// Unhealthy returns true if the health of this service is at least as bad as the threshold provided (either
+// warning or critical)
+func (service *Service) Unhealthy(threshold string) bool {
+	switch service.Health {
+	case consul.HealthCritical:
+		return true
+	case consul.HealthWarning:
+		return threshold == consul.HealthWarning
+	}
+	return false
 }
 
 type NodeServices struct {
@@ -25,6 +55,7 @@ type NodeServices struct {
 
 // Services stores services per node, and handles writing them out to actual config files
 type Services struct {
+	// Services is keyed on ServiceKey, since service IDs are only unique within a node
 	Services      map[string]*Service
 	ByNode        map[string][]*Service
 	MonitorByType map[string][]*Monitor
@@ -39,45 +70,77 @@ func NewServices() Services {
 	}
 }
 
+// ServiceKey returns the key a service is stored under in Services.Services
+func ServiceKey(node string, serviceID string) string {
+	// node names can't contain nulls, so this can't be mistaken for a different node and ID
+	return node + "\x00" + serviceID
+}
+
 // Add adds a new NodeService to our list of services, and overwrites all previous services for that node
 func (services *Services) Add(newService Service) {
-	services.Services[newService.ID] = &newService
+	services.Services[ServiceKey(newService.Node, newService.ID)] = &newService
 	services.ByNode[newService.Node] = append(services.ByNode[newService.Node], &newService)
 
 	// for each monitor add an entry into MonitorByType so we can pull them out later
-	for _, monitor := range newService.Monitors {
+	for index, monitor := range newService.Monitors {
+		// our monitors should always point at the copy of the service we have stored
+		newService.Monitors[index].Service = &newService
+		newService.Monitors[index].Index = index
 		services.MonitorByType[monitor.DatadogType] = append(services.MonitorByType[monitor.DatadogType], &Monitor{
 			ConfigTemplate: monitor.ConfigTemplate,
 			DatadogType:    monitor.DatadogType,
-			Service:        monitor.Service,
+			Params:         monitor.Params,
+			Index:          index,
+			Service:        &newService,
 		})
 	}
 }
 
 // ClearNode will remove all services from a specific node
 func (services *Services) ClearNode(nodeName string) {
-	// run through our services
+	// gather up the services we are removing, and delete them from our list of services
+	removing := make(map[*Service]bool)
 	for _, service := range services.ByNode[nodeName] {
-		for _, monitor := range service.Monitors {
-			// remove the monitors from MonitorByType
-			// first find it
-			var foundIndex int
-			for index, monitorByType := range services.MonitorByType[monitor.DatadogType] {
-				if *monitorByType == monitor {
-					foundIndex = index
-					break
-				}
+		removing[service] = true
+		delete(services.Services, ServiceKey(service.Node, service.ID))
+	}
+
+	// then remove their monitors from MonitorByType
+	for datadogType, monitors := range services.MonitorByType {
+		kept := monitors[:0]
+		for _, monitor := range monitors {
+			if !removing[monitor.Service] {
+				kept = append(kept, monitor)
 			}
-			// then remove it
-			// this deletes it but does not preserve the order of the services (which is fine)
-			// got this from here: https://github.com/golang/go/wiki/SliceTricks as it does not result in memory leaks
-			services.MonitorByType[monitor.DatadogType][foundIndex] = services.MonitorByType[monitor.DatadogType][len(services.MonitorByType[monitor.DatadogType])-1]
-			services.MonitorByType[monitor.DatadogType][len(services.MonitorByType[monitor.DatadogType])-1] = nil
-			services.MonitorByType[monitor.DatadogType] = services.MonitorByType[monitor.DatadogType][:len(services.MonitorByType[monitor.DatadogType])-1]
 		}
-		// then delete our service from our list of services
-		delete(services.Services, service.ID)
+		// clear out the end of the slice so the monitors we removed can be garbage collected
+		for index := len(kept); index < len(monitors); index++ {
+			monitors[index] = nil
+		}
+		// if that was the last monitor of this type we forget about the type altogether
+		if len(kept) == 0 {
+			delete(services.MonitorByType, datadogType)
+		} else {
+			services.MonitorByType[datadogType] = kept
+		}
 	}
+
 	// once we have removed all of our services, we remove them from ByNode as well
 	delete(services.ByNode, nodeName)
 }
+
+// Copy returns a copy of services that can be used while services itself keeps changing.  The services and monitors
+// themselves are shared since they are never changed once they have been added
+func (services *Services) Copy() Services {
+	copied := NewServices()
+	for key, service := range services.Services {
+		copied.Services[key] = service
+	}
+	for node, nodeServices := range services.ByNode {
+		copied.ByNode[node] = append([]*Service(nil), nodeServices...)
+	}
+	for datadogType, monitors := range services.MonitorByType {
+		copied.MonitorByType[datadogType] = append([]*Monitor(nil), monitors...)
+	}
+	return copied
+}
@@ -0,0 +1,40 @@
+package services
+
+import (
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// webService returns a service called web on node, with a single apache monitor
+func webService(node string) Service {
+	return Service{
+		AgentService: consul.AgentService{ID: "web", Service: "web"},
+		Node:         node,
+		Monitors: []Monitor{
+			{ConfigTemplate: "http://templates/apache.yaml", DatadogType: "apache"},
+		},
+	}
+}
+
+func TestClearNodeKeepsSameServiceOnOtherNodes(t *testing.T) {
+	services := NewServices()
+	services.Add(webService("a"))
+	services.Add(webService("b"))
+	if len(services.Services) != 2 {
+		t.Fatalf("expected 2 services, got %d", len(services.Services))
+	}
+
+	services.ClearNode("a")
+	service, found := services.Services[ServiceKey("b", "web")]
+	if !found || service.Node != "b" {
+		t.Fatalf("expected web on node b to still be there, got %v", services.Services)
+	}
+	if _, found := services.Services[ServiceKey("a", "web")]; found {
+		t.Error("expected web on node a to be gone")
+	}
+	monitors := services.MonitorByType["apache"]
+	if len(monitors) != 1 || monitors[0].Service != service {
+		t.Errorf("expected only the monitor for web on node b, got %v", monitors)
+	}
+}